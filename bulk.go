@@ -0,0 +1,185 @@
+package flickgo
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Number of uploads BulkUpload runs at once when BulkOptions.Workers is 0.
+const DefaultBulkWorkers = 4
+
+// A file to upload with BulkUpload.
+type UploadJob struct {
+	// Name of the file; used to detect its type, and to identify it in the
+	// summary.
+	Name string
+
+	// Opens the file.  It is called when the upload starts, so that only the
+	// files being uploaded are open at any time, and the file is closed when
+	// the upload ends.
+	Open func() (io.ReadCloser, error)
+
+	// Size of the file in bytes, or -1 if unknown.
+	Size int64
+
+	// Upload options; may be nil.
+	Options *UploadOptions
+}
+
+// Returns an UploadJob for the file at path.
+func FileJob(path string, opts *UploadOptions) (UploadJob, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return UploadJob{}, wrapErr("stat failed", err)
+	}
+	return UploadJob{
+		Name:    filepath.Base(path),
+		Open:    func() (io.ReadCloser, error) { return os.Open(path) },
+		Size:    fi.Size(),
+		Options: opts,
+	}, nil
+}
+
+// Options for BulkUpload.
+type BulkOptions struct {
+	// Maximum number of concurrent uploads; 0 means DefaultBulkWorkers.
+	Workers int
+
+	// If not empty, uploaded photos are added to this photoset.
+	SetID string
+
+	// Called, if not nil, as soon as Flickr accepts the upload of a job, with
+	// the index of the job in the order the jobs were received and the result
+	// of the upload, which has the ticket ID of an asynchronous upload.  It is
+	// called before the tickets are waited for, and never concurrently.
+	Accepted func(i int, r *UploadResult)
+}
+
+// Outcome of one UploadJob.
+type BulkResult struct {
+	// Name of the job.
+	Name string
+
+	// ID of the uploaded photo; empty if the upload failed.
+	PhotoID string
+
+	// Reason the job failed.  If the photo was uploaded but could not be
+	// added to the set, both PhotoID and Err are set.
+	Err error
+}
+
+// Outcome of a BulkUpload.
+type BulkSummary struct {
+	// Results of all jobs, in the order they were received.
+	Results []BulkResult
+
+	// Number of jobs that succeeded and failed.
+	Succeeded, Failed int
+}
+
+// Uploads the files received from jobs, running up to opts.Workers uploads at
+// once, until jobs is closed.  Asynchronous uploads are then waited for with
+// WaitForTickets, and if opts.SetID is set, the uploaded photos are added to
+// the set in the order their jobs were received.  Failures are reported per
+// job in the returned summary; once c's context is done, the remaining jobs
+// are still read from jobs, but fail without being uploaded.
+func (c *Client) BulkUpload(jobs <-chan UploadJob, opts *BulkOptions) *BulkSummary {
+	if opts == nil {
+		opts = &BulkOptions{}
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultBulkWorkers
+	}
+
+	type indexedJob struct {
+		i   int
+		job UploadJob
+	}
+	var (
+		mu      sync.Mutex
+		results []BulkResult
+		uploads []*UploadResult
+	)
+	queue := make(chan indexedJob)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ij := range queue {
+				r, err := bulkUploadOne(c, ij.job)
+				mu.Lock()
+				results[ij.i].Err = err
+				uploads[ij.i] = r
+				if r != nil && opts.Accepted != nil {
+					opts.Accepted(ij.i, r)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for job := range jobs {
+		mu.Lock()
+		results = append(results, BulkResult{Name: job.Name})
+		uploads = append(uploads, nil)
+		i := len(results) - 1
+		mu.Unlock()
+		queue <- indexedJob{i, job}
+	}
+	close(queue)
+	wg.Wait()
+
+	var tickets []string
+	for _, r := range uploads {
+		if r != nil && r.TicketID != "" {
+			tickets = append(tickets, r.TicketID)
+		}
+	}
+	var ticketResults map[string]TicketResult
+	if len(tickets) > 0 {
+		// Errors are also reported in the results of the pending tickets.
+		ticketResults, _ = c.WaitForTickets(tickets)
+	}
+
+	s := &BulkSummary{Results: results}
+	for i := range results {
+		res := &results[i]
+		if r := uploads[i]; r != nil {
+			res.PhotoID = r.PhotoID
+			if r.TicketID != "" {
+				tr := ticketResults[r.TicketID]
+				res.PhotoID, res.Err = tr.PhotoID, tr.Err
+			}
+		}
+		if res.Err == nil && opts.SetID != "" {
+			err := c.AddPhotoToSet(res.PhotoID, opts.SetID)
+			// A retried request finds the photo added by an earlier attempt.
+			if err != nil && !errors.Is(err, ErrPhotoAlreadyInSet) {
+				res.Err = wrapErr("adding to set failed", err)
+			}
+		}
+		if res.Err == nil {
+			s.Succeeded++
+		} else {
+			s.Failed++
+		}
+	}
+	return s
+}
+
+// Opens and uploads the file of job.
+func bulkUploadOne(c *Client, job UploadJob) (*UploadResult, error) {
+	if err := c.Context().Err(); err != nil {
+		return nil, wrapErr("upload cancelled", err)
+	}
+	f, err := job.Open()
+	if err != nil {
+		return nil, wrapErr("opening file failed", err)
+	}
+	defer f.Close()
+	return c.UploadWithOptions(job.Name, f, job.Size, job.Options)
+}
@@ -0,0 +1,173 @@
+package flickgo
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Error returned when uploading a file that is neither a photo nor a video in
+// a format Flickr accepts.
+var ErrUnsupportedType = errors.New("unsupported file type")
+
+// Number of leading bytes of a file examined to detect its type.
+const sniffLen = 512
+
+// MIME types of the photo and video formats Flickr accepts, keyed by file
+// extension.
+var contentType = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".jpe":  "image/jpeg",
+	".gif":  "image/gif",
+	".png":  "image/png",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".bmp":  "image/bmp",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".avi":  "video/x-msvideo",
+	".wmv":  "video/x-ms-wmv",
+	".mpg":  "video/mpeg",
+	".mpeg": "video/mpeg",
+	".3gp":  "video/3gpp",
+	".3g2":  "video/3gpp2",
+	".m2ts": "video/mp2t",
+	".mts":  "video/mp2t",
+	".ts":   "video/mp2t",
+	".ogg":  "video/ogg",
+	".ogv":  "video/ogg",
+}
+
+// Reports whether Flickr accepts files of MIME type t.
+func supportedType(t string) bool {
+	for _, s := range contentType {
+		if s == t {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the MIME type of a file named filename whose content starts with
+// head, which should hold its first sniffLen bytes.  The type is detected from
+// head, and from filename's extension only if head is binary data of no known
+// type.  Returns an error wrapping ErrUnsupportedType if the file is not in a
+// format Flickr accepts.
+func detectContentType(filename string, head []byte) (string, error) {
+	sniffed := sniffContentType(head)
+	if supportedType(sniffed) {
+		return sniffed, nil
+	}
+	if sniffed == "application/octet-stream" {
+		if t, ok := contentType[strings.ToLower(filepath.Ext(filename))]; ok {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %s (%s)", ErrUnsupportedType, filename, sniffed)
+}
+
+// MIME types of ISO base media files (ftyp boxes), keyed by major brand.
+var ftypBrands = map[string]string{
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"iso4": "video/mp4",
+	"iso5": "video/mp4",
+	"iso6": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"dash": "video/mp4",
+	"mmp4": "video/mp4",
+	"MSNV": "video/mp4",
+	"f4v ": "video/mp4",
+	"M4V ": "video/mp4",
+	"M4VH": "video/mp4",
+	"M4VP": "video/mp4",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"qt  ": "video/quicktime",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+	"3gp6": "video/3gpp",
+	"3gp7": "video/3gpp",
+	"3gs7": "video/3gpp",
+	"3g2a": "video/3gpp2",
+	"3g2b": "video/3gpp2",
+	"3g2c": "video/3gpp2",
+	"M4A ": "audio/mp4",
+	"M4B ": "audio/mp4",
+	"avif": "image/avif",
+	"avis": "image/avif",
+}
+
+// ASF header object GUID, which starts WMV files.
+var asfHeader = []byte{
+	0x30, 0x26, 0xb2, 0x75, 0x8e, 0x66, 0xcf, 0x11,
+	0xa6, 0xd9, 0x00, 0xaa, 0x00, 0x62, 0xce, 0x6c,
+}
+
+// Returns the MIME type of the data starting with head, using
+// http.DetectContentType for the formats it knows and magic numbers for the
+// others.
+func sniffContentType(head []byte) string {
+	switch {
+	case len(head) == 0:
+		// Nothing to go by; unlike http.DetectContentType, not text.
+		return "application/octet-stream"
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		if t, ok := ftypBrands[string(head[8:12])]; ok {
+			return t
+		}
+		// Some other kind of ISO base media file.
+		return "application/mp4"
+	case len(head) >= 8 && (string(head[4:8]) == "moov" || string(head[4:8]) == "mdat" ||
+		string(head[4:8]) == "wide"):
+		return "video/quicktime"
+	case bytes.HasPrefix(head, []byte("II*\x00")) || bytes.HasPrefix(head, []byte("MM\x00*")):
+		return "image/tiff"
+	case bytes.HasPrefix(head, asfHeader):
+		return "video/x-ms-wmv"
+	case transportStream(head, 0, 188):
+		return "video/mp2t"
+	case transportStream(head, 4, 192):
+		return "video/mp2t"
+	case bytes.HasPrefix(head, []byte{0x00, 0x00, 0x01, 0xba}) ||
+		bytes.HasPrefix(head, []byte{0x00, 0x00, 0x01, 0xb3}):
+		return "video/mpeg"
+	}
+	switch t := http.DetectContentType(head); t {
+	case "video/avi":
+		return "video/x-msvideo"
+	case "application/ogg":
+		return "video/ogg"
+	default:
+		return t
+	}
+}
+
+// Reports whether head holds MPEG transport stream packets of packetLen bytes,
+// each having its sync byte at offset.  At least two packets must be present.
+func transportStream(head []byte, offset, packetLen int) bool {
+	if len(head) < offset+packetLen+1 {
+		return false
+	}
+	for i := offset; i < len(head); i += packetLen {
+		if head[i] != 0x47 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,430 @@
+package flickgo
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Name of the file SyncDir keeps its state in, in the synced directory, when
+// SyncOptions.StateFile is empty.
+const DefaultSyncStateFile = ".flickgo-sync.json"
+
+// Number of files SyncDir uploads before waiting for their tickets and adding
+// them to the set.
+const syncBatchSize = 20
+
+// Options for SyncDir.
+type SyncOptions struct {
+	// ID of the photoset to sync to.  If empty, the set is looked up by
+	// SetTitle among the sets of UserID.
+	SetID string
+
+	// Title of the photoset, used when SetID is empty.
+	SetTitle string
+
+	// Description given to the photoset if it is created.
+	SetDescription string
+
+	// Owner of the photoset; empty means the authenticated user.
+	UserID string
+
+	// Whether to create the photoset if it does not exist.  Since Flickr
+	// needs a primary photo to create a set, the set is created once the
+	// first photo is uploaded.
+	CreateSet bool
+
+	// Path of the state file; empty means DefaultSyncStateFile in the synced
+	// directory.
+	StateFile string
+
+	// Maximum number of concurrent uploads; 0 means DefaultBulkWorkers.
+	Workers int
+
+	// Options for each upload; may be nil.
+	Options *UploadOptions
+}
+
+// State of a synced directory, saved by SyncDir between runs.
+type SyncState struct {
+	// ID of the photoset the directory is synced to.
+	SetID string `json:"set_id"`
+
+	// IDs of the uploaded photos, keyed by the hex encoded SHA-256 hash of
+	// their content.
+	Photos map[string]string `json:"photos"`
+
+	// IDs of uploaded photos that are yet to be added to the set.
+	Unsorted []string `json:"unsorted,omitempty"`
+
+	// Tickets of asynchronous uploads that are yet to complete, keyed like
+	// Photos.  They are waited for by the next run.
+	Tickets map[string]string `json:"tickets,omitempty"`
+}
+
+// Outcome of a SyncDir run.
+type SyncSummary struct {
+	// ID of the photoset the directory is synced to.
+	SetID string
+
+	// Results of the files uploaded by this run.  A result with both PhotoID
+	// and Err set is for a photo that was uploaded but not added to the set;
+	// adding it is retried by the next run.  Likewise, uploads that Flickr
+	// accepted but did not finish processing are waited for by the next run.
+	Uploaded []BulkResult
+
+	// Names of the files that were uploaded by earlier runs, or that have the
+	// same content as another file.
+	Skipped []string
+
+	// Names of the files that are not in a format Flickr accepts.
+	Unsupported []string
+
+	// Number of files in Uploaded that failed.
+	Failed int
+}
+
+// A file to be synced.
+type syncFile struct {
+	path string
+	name string
+	hash string
+	size int64
+}
+
+// Uploads the photos and videos in dir that have not been uploaded yet to
+// the photoset given by opts, and adds them to the set.  Files are identified
+// by the hash of their content, so renamed files are not uploaded again.
+// Hidden files and subdirectories are ignored.  Progress is saved in a state
+// file as each upload is accepted and after every few uploads, so SyncDir can
+// be run again after it fails or is interrupted; the state file is replaced
+// atomically, so it is never left partially written.
+//
+// Per-file failures are reported in the returned summary; the returned error
+// is for failures that stop the sync, such as not finding the set.
+func (c *Client) SyncDir(dir string, opts *SyncOptions) (*SyncSummary, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+	statePath := opts.StateFile
+	if statePath == "" {
+		statePath = filepath.Join(dir, DefaultSyncStateFile)
+	}
+	st, err := loadSyncState(statePath)
+	if err != nil {
+		return nil, err
+	}
+	if st.SetID == "" {
+		if st.SetID, err = findSet(c, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &SyncSummary{}
+	files, unsupported, err := syncFiles(dir, statePath)
+	if err != nil {
+		return nil, err
+	}
+	s.Unsupported = unsupported
+
+	// Resolves the uploads of an earlier run that were still being processed.
+	if len(st.Tickets) > 0 {
+		tErr := resolveTickets(c, st, files)
+		if err := saveSyncState(statePath, st); err != nil {
+			return nil, err
+		}
+		if tErr != nil {
+			return nil, tErr
+		}
+	}
+
+	// Adds the photos uploaded by an earlier run that did not make it to the
+	// set.
+	if _, err := sortPhotos(c, st, opts); err != nil {
+		return nil, err
+	}
+
+	var todo []syncFile
+	queued := make(map[string]bool)
+	for _, f := range files {
+		if st.Photos[f.hash] != "" || queued[f.hash] {
+			s.Skipped = append(s.Skipped, f.name)
+			continue
+		}
+		queued[f.hash] = true
+		todo = append(todo, f)
+	}
+
+	for start := 0; start < len(todo); start += syncBatchSize {
+		if err := c.Context().Err(); err != nil {
+			s.SetID = st.SetID
+			return s, wrapErr("sync cancelled", err)
+		}
+		end := start + syncBatchSize
+		if end > len(todo) {
+			end = len(todo)
+		}
+		batch := todo[start:end]
+		jobs := make(chan UploadJob, len(batch))
+		for _, f := range batch {
+			jobs <- syncJob(f, opts.Options)
+		}
+		close(jobs)
+		// Records each upload as soon as it is accepted, so that it is not
+		// lost if waiting for its ticket fails or the process is stopped.
+		var saveErr error
+		accepted := func(i int, r *UploadResult) {
+			if r.TicketID != "" {
+				st.Tickets[batch[i].hash] = r.TicketID
+			} else {
+				st.Photos[batch[i].hash] = r.PhotoID
+				st.Unsorted = append(st.Unsorted, r.PhotoID)
+			}
+			if err := saveSyncState(statePath, st); err != nil && saveErr == nil {
+				saveErr = err
+			}
+		}
+		r := c.BulkUpload(jobs, &BulkOptions{Workers: opts.Workers, Accepted: accepted})
+		if saveErr != nil {
+			s.SetID = st.SetID
+			return s, saveErr
+		}
+
+		for i, res := range r.Results {
+			if st.Tickets[batch[i].hash] != "" {
+				recordTicket(st, batch[i].hash, TicketResult{PhotoID: res.PhotoID, Err: res.Err})
+			}
+		}
+		setErrs, sErr := sortPhotos(c, st, opts)
+		if err := saveSyncState(statePath, st); err != nil {
+			return s, err
+		}
+		if sErr != nil {
+			s.SetID = st.SetID
+			return s, sErr
+		}
+		for _, res := range r.Results {
+			if res.Err == nil && setErrs[res.PhotoID] != nil {
+				res.Err = wrapErr("adding to set failed", setErrs[res.PhotoID])
+			}
+			if res.Err != nil {
+				s.Failed++
+			}
+			s.Uploaded = append(s.Uploaded, res)
+		}
+	}
+	s.SetID = st.SetID
+	return s, saveSyncState(statePath, st)
+}
+
+// Returns the ID of the photoset given by opts, or "" if it does not exist
+// and is to be created.
+func findSet(c *Client, opts *SyncOptions) (string, error) {
+	if opts.SetID != "" {
+		return opts.SetID, nil
+	}
+	if opts.SetTitle == "" {
+		return "", errors.New("no photoset specified")
+	}
+	sets, err := c.GetSets(opts.UserID)
+	if err != nil {
+		return "", wrapErr("listing photosets failed", err)
+	}
+	for _, set := range sets {
+		if set.Title == opts.SetTitle {
+			return set.ID, nil
+		}
+	}
+	if !opts.CreateSet {
+		return "", fmt.Errorf("photoset %q not found", opts.SetTitle)
+	}
+	return "", nil
+}
+
+// Waits for the tickets in st.Tickets and records their outcome in st, in the
+// order of files, followed by the tickets of files no longer in the
+// directory.  The returned error is that of WaitForTickets, in which case the
+// tickets that are still pending are kept.
+func resolveTickets(c *Client, st *SyncState, files []syncFile) error {
+	hashes := make([]string, 0, len(st.Tickets))
+	tickets := make([]string, 0, len(st.Tickets))
+	for hash, t := range st.Tickets {
+		hashes = append(hashes, hash)
+		tickets = append(tickets, t)
+	}
+	results, err := c.WaitForTickets(tickets)
+	sort.Strings(hashes)
+	for _, f := range files {
+		if t, ok := st.Tickets[f.hash]; ok {
+			recordTicket(st, f.hash, results[t])
+		}
+	}
+	for _, hash := range hashes {
+		if t, ok := st.Tickets[hash]; ok {
+			recordTicket(st, hash, results[t])
+		}
+	}
+	return err
+}
+
+// Records in st the outcome of the ticket of the file whose hash is hash.  The
+// ticket is dropped once it resolves to a photo, or if it will never complete,
+// in which case the file is uploaded again by the next run.
+func recordTicket(st *SyncState, hash string, r TicketResult) {
+	switch {
+	case r.PhotoID != "":
+		st.Photos[hash] = r.PhotoID
+		st.Unsorted = append(st.Unsorted, r.PhotoID)
+	case !errors.Is(r.Err, ErrInvalidTicket) && !errors.Is(r.Err, ErrUploadFailed):
+		return
+	}
+	delete(st.Tickets, hash)
+}
+
+// Adds the photos in st.Unsorted to st's set, creating the set first if
+// necessary.  The photos that could not be added are left in st.Unsorted,
+// and returned along with the errors adding them.  An error is returned only
+// if creating the set fails.
+func sortPhotos(c *Client, st *SyncState, opts *SyncOptions) (map[string]error, error) {
+	if len(st.Unsorted) == 0 {
+		return nil, nil
+	}
+	if st.SetID == "" {
+		set, err := c.CreateSet(opts.SetTitle, opts.SetDescription, st.Unsorted[0])
+		if err != nil {
+			return nil, wrapErr("photoset creation failed", err)
+		}
+		st.SetID = set.ID
+		st.Unsorted = st.Unsorted[1:]
+	}
+	errs := make(map[string]error)
+	var unsorted []string
+	for _, id := range st.Unsorted {
+		// The photo may have been added by an earlier run that stopped
+		// before saving its state, or by an attempt whose response was lost.
+		err := c.AddPhotoToSet(id, st.SetID)
+		if err != nil && !errors.Is(err, ErrPhotoAlreadyInSet) {
+			errs[id] = err
+			unsorted = append(unsorted, id)
+		}
+	}
+	st.Unsorted = unsorted
+	return errs, nil
+}
+
+// Returns an UploadJob for f.
+func syncJob(f syncFile, opts *UploadOptions) UploadJob {
+	return UploadJob{
+		Name:    f.name,
+		Open:    func() (io.ReadCloser, error) { return os.Open(f.path) },
+		Size:    f.size,
+		Options: opts,
+	}
+}
+
+// Returns the files in dir to be synced, in name order, and the names of the
+// files that Flickr does not accept.  Hidden files and statePath are skipped.
+func syncFiles(dir string, statePath string) ([]syncFile, []string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, wrapErr("reading directory failed", err)
+	}
+	var files []syncFile
+	var unsupported []string
+	for _, fi := range infos {
+		p := filepath.Join(dir, fi.Name())
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") ||
+			p == filepath.Clean(statePath) {
+			continue
+		}
+		hash, head, err := hashFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, err := detectContentType(fi.Name(), head); err != nil {
+			unsupported = append(unsupported, fi.Name())
+			continue
+		}
+		files = append(files, syncFile{path: p, name: fi.Name(), hash: hash, size: fi.Size()})
+	}
+	return files, unsupported, nil
+}
+
+// Returns the hex encoded SHA-256 hash of the file at path, and its first
+// sniffLen bytes.
+func hashFile(path string) (string, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, wrapErr("opening file failed", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	head := make([]byte, sniffLen)
+	n, rErr := io.ReadFull(f, head)
+	if rErr != nil && rErr != io.EOF && rErr != io.ErrUnexpectedEOF {
+		return "", nil, wrapErr("reading file failed", rErr)
+	}
+	head = head[:n]
+	h.Write(head)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", nil, wrapErr("reading file failed", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), head, nil
+}
+
+// Reads the state saved at path; returns an empty state if there is no file
+// at path.
+func loadSyncState(path string) (*SyncState, error) {
+	st := &SyncState{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, wrapErr("reading state failed", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, st); err != nil {
+			return nil, wrapErr("parsing state failed", err)
+		}
+	}
+	if st.Photos == nil {
+		st.Photos = make(map[string]string)
+	}
+	if st.Tickets == nil {
+		st.Tickets = make(map[string]string)
+	}
+	return st, nil
+}
+
+// Saves st at path, by writing it to a temporary file and renaming the file.
+func saveSyncState(path string, st *SyncState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return wrapErr("encoding state failed", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return wrapErr("saving state failed", err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return wrapErr("saving state failed", err)
+	}
+	return nil
+}
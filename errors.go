@@ -0,0 +1,142 @@
+package flickgo
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Error returned when Flickr reports a failure of an API call.  Use errors.As
+// to access the details, or errors.Is to compare against one of the Err*
+// values below.
+type Error struct {
+	// Flickr's error code.  Codes are specific to each API method, except for
+	// the ones from 95 onwards, which are common to all methods.  See
+	// https://www.flickr.com/services/api/ for the codes of each method.
+	Code int
+
+	// Error message returned by Flickr.
+	Message string
+
+	// The API method that failed; "upload" for uploads.
+	Method string
+
+	// HTTP status code of the response that reported the error.
+	HTTPStatus int
+
+	// If set, Is matches errors from any of these methods instead of Method.
+	methods map[string]bool
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("Flickr error code %d: %s", e.Code, e.Message)
+	if e.Method != "" {
+		msg = e.Method + ": " + msg
+	}
+	return msg
+}
+
+// Reports whether target is an *Error with the same code as e.  If target has
+// its Method set, e's Method must be the same; this allows matching codes that
+// have different meanings for different methods.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || t.Code != e.Code {
+		return false
+	}
+	if t.methods != nil {
+		return t.methods[e.Method]
+	}
+	return t.Method == "" || t.Method == e.Method
+}
+
+// Commonly encountered Flickr errors, for use with errors.Is.
+var (
+	// Photo ID passed to a method does not exist, or the caller does not have
+	// permission to see it.  Matches code 1 from the methods for which it
+	// means that.
+	ErrPhotoNotFound = &Error{Code: 1, Message: "Photo not found", methods: map[string]bool{
+		"flickr.photos.addTags":             true,
+		"flickr.photos.delete":              true,
+		"flickr.photos.getAllContexts":      true,
+		"flickr.photos.getContext":          true,
+		"flickr.photos.getExif":             true,
+		"flickr.photos.getFavorites":        true,
+		"flickr.photos.getInfo":             true,
+		"flickr.photos.getPerms":            true,
+		"flickr.photos.getSizes":            true,
+		"flickr.photos.setContentType":      true,
+		"flickr.photos.setDates":            true,
+		"flickr.photos.setMeta":             true,
+		"flickr.photos.setPerms":            true,
+		"flickr.photos.setSafetyLevel":      true,
+		"flickr.photos.setTags":             true,
+		"flickr.photos.geo.getLocation":     true,
+		"flickr.photos.licenses.setLicense": true,
+		"flickr.photos.comments.getList":    true,
+	}}
+
+	// Photo passed to AddPhotoToSet is already in the set.
+	ErrPhotoAlreadyInSet = &Error{Code: 3, Message: "Photo already in set",
+		Method: "flickr.photosets.addPhoto"}
+
+	// Request signature is wrong; usually caused by a wrong API secret.
+	ErrInvalidSignature = &Error{Code: 96, Message: "Invalid signature"}
+
+	// Request was not signed.
+	ErrMissingSignature = &Error{Code: 97, Message: "Missing signature"}
+
+	// Auth token is invalid or has been revoked.
+	ErrInvalidAuthToken = &Error{Code: 98, Message: "Invalid auth token"}
+
+	// Token does not grant the permissions needed by the method.
+	ErrInsufficientPermissions = &Error{Code: 99, Message: "Insufficient permissions"}
+
+	// API key is invalid or has expired.
+	ErrInvalidAPIKey = &Error{Code: 100, Message: "Invalid API Key"}
+
+	// Flickr is temporarily unable to process requests.
+	ErrServiceUnavailable = &Error{Code: 105, Message: "Service currently unavailable"}
+)
+
+// Maximum number of bytes of the response body kept in HTTPError.
+const maxErrorBody = 512
+
+// Error returned when Flickr, or a proxy in front of it, responds with an HTTP
+// error status instead of a Flickr API response.  Such failures are usually
+// transient, unlike the ones reported using Error.
+type HTTPError struct {
+	// HTTP status code of the response; 502, for example.
+	StatusCode int
+
+	// HTTP status line of the response; "502 Bad Gateway", for example.
+	Status string
+
+	// Leading part of the response body, for diagnosis.
+	Body string
+}
+
+func (e *HTTPError) Error() string {
+	status := e.Status
+	if status == "" {
+		status = strconv.Itoa(e.StatusCode)
+	}
+	return fmt.Sprintf("HTTP error %s: %s", status, e.Body)
+}
+
+// Error details in a failure response from Flickr.
+type flickrError struct {
+	Code string `xml:"code,attr" json:"code"`
+	Msg  string `xml:"msg,attr" json:"message"`
+}
+
+// Converts e into an *Error reported for method.  httpStatus is the status
+// code of the response containing e.
+func (e *flickrError) Err(method string, httpStatus int) error {
+	code, _ := strconv.Atoi(e.Code)
+	return &Error{
+		Code:       code,
+		Message:    e.Msg,
+		Method:     method,
+		HTTPStatus: httpStatus,
+	}
+}
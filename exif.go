@@ -0,0 +1,133 @@
+package flickgo
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EXIF, IPTC and XMP metadata of a photo, returned by GetExif.
+type Exif struct {
+	ID     string `xml:"id,attr" json:"id"`
+	Secret string `xml:"secret,attr" json:"secret"`
+	Server string `xml:"server,attr" json:"server"`
+	Farm   string `xml:"farm,attr" json:"farm"`
+	// Camera make and model, as named by Flickr.
+	Camera string    `xml:"camera,attr" json:"camera"`
+	Tags   []ExifTag `xml:"exif" json:"exif"`
+}
+
+// A metadata entry of a photo.
+type ExifTag struct {
+	// Namespace of the tag, like "EXIF", "IFD0", "IPTC" or "XMP-aux".
+	TagSpace   string `xml:"tagspace,attr" json:"tagspace"`
+	TagSpaceID string `xml:"tagspaceid,attr" json:"tagspaceid"`
+	// Name of the tag, like "ExposureTime".
+	Tag string `xml:"tag,attr" json:"tag"`
+	// Human readable name of the tag, like "Exposure".
+	Label string `xml:"label,attr" json:"label"`
+	// Value of the tag, as stored in the photo.
+	Raw string `xml:"raw" json:"raw"`
+	// Value of the tag formatted for display; not set for all tags.
+	Clean string `xml:"clean" json:"clean"`
+}
+
+// Returns the value of the tag: Clean if set, Raw otherwise.
+func (t *ExifTag) Value() string {
+	if t.Clean != "" {
+		return t.Clean
+	}
+	return t.Raw
+}
+
+// Returns the first entry with one of the given tag names, or nil if there
+// is none.
+func (e *Exif) Get(tags ...string) *ExifTag {
+	for _, name := range tags {
+		for i := range e.Tags {
+			if e.Tags[i].Tag == name {
+				return &e.Tags[i]
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the raw value of the first entry with one of the given tag names,
+// or "" if there is none.
+func (e *Exif) raw(tags ...string) string {
+	if t := e.Get(tags...); t != nil {
+		return strings.TrimSpace(t.Raw)
+	}
+	return ""
+}
+
+// Returns the camera manufacturer.
+func (e *Exif) Make() string {
+	return e.raw("Make")
+}
+
+// Returns the camera model.
+func (e *Exif) Model() string {
+	return e.raw("Model")
+}
+
+// Returns the lens model.
+func (e *Exif) Lens() string {
+	return e.raw("LensModel", "Lens", "LensInfo")
+}
+
+// Returns the exposure time, or false if it is not known.
+func (e *Exif) ExposureTime() (time.Duration, bool) {
+	secs, ok := parseRational(e.raw("ExposureTime"))
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+// Returns the f-number of the aperture, like 5.6, or false if it is not
+// known.
+func (e *Exif) Aperture() (float64, bool) {
+	if f, ok := parseRational(e.raw("FNumber")); ok {
+		return f, true
+	}
+	// The APEX value a is the f-number squared, in stops: f = 2^(a/2).
+	if a, ok := parseRational(e.raw("ApertureValue")); ok {
+		return math.Pow(2, a/2), true
+	}
+	return 0, false
+}
+
+// Returns the focal length in millimetres, or false if it is not known.
+func (e *Exif) FocalLength() (float64, bool) {
+	return parseRational(strings.TrimSuffix(e.raw("FocalLength"), " mm"))
+}
+
+// Returns the ISO speed, or false if it is not known.
+func (e *Exif) ISO() (int, bool) {
+	iso, err := strconv.Atoi(e.raw("ISO", "ISOSpeedRatings", "ISOSpeed"))
+	return iso, err == nil
+}
+
+// Returns the date and time the photo was taken, in the UTC location since
+// EXIF dates do not record the time zone, or false if it is not known.
+func (e *Exif) DateTaken() (time.Time, bool) {
+	t, err := time.Parse("2006:01:02 15:04:05", e.raw("DateTimeOriginal", "CreateDate"))
+	return t, err == nil
+}
+
+// Parses a decimal number, or a fraction like "1/60".
+func parseRational(s string) (float64, bool) {
+	if i := strings.Index(s, "/"); i >= 0 {
+		num, nErr := strconv.ParseFloat(strings.TrimSpace(s[:i]), 64)
+		den, dErr := strconv.ParseFloat(strings.TrimSpace(s[i+1:]), 64)
+		if nErr != nil || dErr != nil || den == 0 {
+			return 0, false
+		}
+		return num / den, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
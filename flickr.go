@@ -3,10 +3,13 @@
 package flickgo
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"io"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Flickr API permission levels.  See
@@ -17,6 +20,13 @@ const (
 	DeletePerm = "delete"
 )
 
+// Formats in which Flickr can send API responses.  See
+// http://www.flickr.com/services/api/response.json.html.
+const (
+	FormatXML  = "rest"
+	FormatJSON = "json"
+)
+
 // Debug logger.
 type Debugfer interface {
 	// Debugf formats its arguments according to the format, analogous to fmt.Printf,
@@ -26,9 +36,30 @@ type Debugfer interface {
 
 // Flickr client.
 type Client struct {
-	// Auth token for acting on behalf of a user.
+	// Auth token for acting on behalf of a user.  Flickr has retired this
+	// authentication scheme; use OAuthToken for new users.
 	AuthToken string
 
+	// OAuth access token and token secret for acting on behalf of a user.  When
+	// OAuthToken is set, all requests are signed using OAuth and AuthToken is
+	// ignored.  See GetRequestToken and GetAccessToken.
+	OAuthToken       string
+	OAuthTokenSecret string
+
+	// Policy for retrying requests that fail with transient errors; nil
+	// disables retries.  See DefaultRetryPolicy.
+	Retry *RetryPolicy
+
+	// Limiter that paces requests made by the client; nil disables rate
+	// limiting.  New sets it to SharedLimiter(apiKey).
+	Limiter Limiter
+
+	// Format in which Flickr should send API responses: FormatXML (the
+	// default) or FormatJSON.  Responses are decoded into the same types in
+	// either case; this only affects what goes over the wire.  Uploads
+	// always use XML.
+	Format string
+
 	// Logger to use.
 	// Hint: App engine's Context implements this interface.
 	Logger Debugfer
@@ -41,6 +72,9 @@ type Client struct {
 
 	// Client to use for HTTP communication.
 	httpClient *http.Client
+
+	// Context for HTTP requests; nil means context.Background().
+	ctx context.Context
 }
 
 // Creates a new Client object.  See
@@ -52,11 +86,79 @@ func New(apiKey string, secret string, httpClient *http.Client) *Client {
 		apiKey:     apiKey,
 		secret:     secret,
 		httpClient: httpClient,
+		Limiter:    SharedLimiter(apiKey),
+	}
+}
+
+// Returns a shallow copy of c that makes its requests with ctx.  Cancelling
+// ctx, or reaching its deadline, aborts requests in progress (including
+// uploads) and makes further requests fail.  For example:
+//     sets, err := c.WithContext(ctx).GetSets(userID)
+func (c *Client) WithContext(ctx context.Context) *Client {
+	if ctx == nil {
+		panic("nil context")
+	}
+	c2 := *c
+	c2.ctx = ctx
+	return &c2
+}
+
+// Returns the context used for c's requests.  See WithContext.
+func (c *Client) Context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
+// Invokes the Flickr API method with the given arguments.  If authenticated
+// is true, the request is made on behalf of the user whose token c has.  The
+// response is decoded into out, which should point to a struct with fields
+// for the children of the response's <rsp> element (or the members of the
+// top-level object, if c.Format is FormatJSON).  For example:
+//     r := struct {
+//         Person struct {
+//             RealName string `xml:"realname" json:"realname"`
+//         } `xml:"person" json:"person"`
+//     }{}
+//     err := c.Call("flickr.people.getInfo", args, false, &r)
+// out may be nil if the response is not needed.  If Flickr reports a
+// failure, the returned error is an *Error.  Use this method for calling API
+// methods for which Client does not have a method yet.  Since the method may
+// modify data, authenticated calls are sent as POST requests, as Flickr
+// requires for such methods, and calls are retried only when Flickr reports a
+// retryable error; use CallIdempotent for methods that can safely be
+// repeated.
+func (c *Client) Call(method string, args map[string]string, authenticated bool,
+	out interface{}) error {
+	return call(c, false, method, args, authenticated, out)
+}
+
+// Same as Call, but for methods that can safely be repeated, like the ones
+// that only read data; they are sent as GET requests, and are also retried
+// after network failures and HTTP errors.
+func (c *Client) CallIdempotent(method string, args map[string]string, authenticated bool,
+	out interface{}) error {
+	return call(c, true, method, args, authenticated, out)
+}
+
+func call(c *Client, idempotent bool, method string, args map[string]string,
+	authenticated bool, out interface{}) error {
+	if out == nil {
+		out = &struct{}{}
 	}
+	// Methods that modify data all require authentication.
+	if !idempotent && authenticated {
+		return flickrPostForm(c, false, method, args, out)
+	}
+	return flickrGet(c, idempotent, func() string {
+		return makeURL(c, method, args, authenticated)
+	}, out)
 }
 
 // Returns the URL for requesting authorisation to access the user's Flickr
-// account.  List of possible permissions are defined at
+// account using the legacy authentication scheme; new apps should use
+// AuthorizeURL.  List of possible permissions are defined at
 // http://www.flickr.com/services/api/auth.spec.html.  You can also use one of
 // the following constants:
 //     ReadPerm
@@ -80,35 +182,60 @@ func getTokenURL(c *Client, frob string) string {
 	return makeURL(c, "flickr.auth.getToken", map[string]string{"frob": frob}, true)
 }
 
-type flickrError struct {
-	Code string `xml:"code,attr"`
-	Msg  string `xml:"msg,attr"`
-}
-
-func (e *flickrError) Err() error {
-	return fmt.Errorf("Flickr error code %s: %s", e.Code, e.Msg)
-}
-
 // Exchanges a temporary frob for a token that's valid forever.
 // See http://www.flickr.com/services/api/auth.howto.web.html.
 func (c *Client) GetToken(frob string) (string, *User, error) {
 	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Err  flickrError `xml:"err"`
 		Auth struct {
-			Token string `xml:"token"`
-			User  User   `xml:"user"`
-		} `xml:"auth"`
+			Token string `xml:"token" json:"token"`
+			User  User   `xml:"user" json:"user"`
+		} `xml:"auth" json:"auth"`
 	}{}
-	if err := flickrGet(c, getTokenURL(c, frob), &r); err != nil {
+	if err := flickrGet(c, true, func() string {
+		return getTokenURL(c, frob)
+	}, &r); err != nil {
 		return "", nil, err
 	}
-	if r.Stat != "ok" {
-		return "", nil, r.Err.Err()
-	}
 	return r.Auth.Token, &r.Auth.User, nil
 }
 
+// Returns the URL for checking c's token: flickr.auth.oauth.checkToken if c has
+// an OAuth token, or flickr.auth.checkToken otherwise.
+func checkTokenURL(c *Client) string {
+	if c.OAuthToken != "" {
+		return makeURL(c, "flickr.auth.oauth.checkToken", map[string]string{}, true)
+	}
+	return makeURL(c, "flickr.auth.checkToken", map[string]string{}, true)
+}
+
+// Checks whether c's OAuthToken (or AuthToken, if OAuthToken is not set) is
+// still valid, and returns the permissions it grants along with the user it
+// belongs to.  Interface for
+// https://www.flickr.com/services/api/flickr.auth.checkToken.html and
+// https://www.flickr.com/services/api/flickr.auth.oauth.checkToken.html API
+// methods.
+func (c *Client) CheckToken() (perms string, user *User, err error) {
+	type tokenInfo struct {
+		Token string `xml:"token" json:"token"`
+		Perms string `xml:"perms" json:"perms"`
+		User  User   `xml:"user" json:"user"`
+	}
+	r := struct {
+		Auth  tokenInfo `xml:"auth" json:"auth"`
+		OAuth tokenInfo `xml:"oauth" json:"oauth"`
+	}{}
+	if err := flickrGet(c, true, func() string {
+		return checkTokenURL(c)
+	}, &r); err != nil {
+		return "", nil, err
+	}
+	info := r.Auth
+	if c.OAuthToken != "" {
+		info = r.OAuth
+	}
+	return info.Perms, &info.User, nil
+}
+
 // Returns URL for Flickr photo search.
 func searchURL(c *Client, args map[string]string) string {
 	argsCopy := clone(args)
@@ -120,16 +247,13 @@ func searchURL(c *Client, args map[string]string) string {
 // http://www.flickr.com/services/api/flickr.photos.search.html.
 func (c *Client) Search(args map[string]string) (*SearchResponse, error) {
 	r := struct {
-		Stat   string         `xml:"stat,attr"`
-		Err    flickrError    `xml:"err"`
-		Photos SearchResponse `xml:"photos"`
+		Photos SearchResponse `xml:"photos" json:"photos"`
 	}{}
-	if err := flickrGet(c, searchURL(c, args), &r); err != nil {
+	if err := flickrGet(c, true, func() string {
+		return searchURL(c, args)
+	}, &r); err != nil {
 		return nil, err
 	}
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
 
 	for i, ph := range r.Photos.Photos {
 		h, hErr := strconv.ParseFloat(ph.HeightT, 64)
@@ -147,23 +271,194 @@ func (c *Client) Search(args map[string]string) (*SearchResponse, error) {
 // http://www.flickr.com/services/api/upload.async.html for details.
 func (c *Client) Upload(name string, photo []byte,
 	args map[string]string) (ticketID string, err error) {
-	req, uErr := uploadRequest(c, name, photo, args)
+	return c.UploadReader(name, bytes.NewReader(photo), int64(len(photo)), args)
+}
+
+// Same as Upload, but reads the photo from photo as it is being sent, instead
+// of holding it in memory.  size is the number of bytes photo has, or -1 if
+// not known in advance; the upload fails if photo has fewer bytes than size.
+func (c *Client) UploadReader(name string, photo io.Reader, size int64,
+	args map[string]string) (ticketID string, err error) {
+	return c.UploadWithProgress(name, photo, size, args, nil)
+}
+
+// Called as a photo is being uploaded, with the number of bytes of the photo
+// sent so far and the total size of the photo (-1 if unknown).  It is called
+// once with sent set to 0 before sending begins, and then each time a chunk of
+// the photo has been sent; calls stop coming if the upload stalls.  It is
+// called from a goroutine other than the one that started the upload.
+type ProgressFunc func(sent, total int64)
+
+// Same as UploadReader, but calls progress, if not nil, as the photo is being
+// sent.  If the upload is retried, progress starts again from 0.
+func (c *Client) UploadWithProgress(name string, photo io.Reader, size int64,
+	args map[string]string, progress ProgressFunc) (ticketID string, err error) {
+	a := clone(args)
+	a["async"] = "1"
+	ticketID, _, err = upload(c, uploadURL, name, photo, size, a, progress)
+	return ticketID, err
+}
+
+// Uploads a photo synchronously, which means Flickr responds only after it
+// has processed the photo, and returns the ID of the new photo.  Parameters
+// are the same as UploadWithProgress.  See
+// http://www.flickr.com/services/api/upload.api.html for details.
+func (c *Client) UploadSync(name string, photo io.Reader, size int64,
+	args map[string]string, progress ProgressFunc) (photoID string, err error) {
+	a := clone(args)
+	a["async"] = "0"
+	_, photoID, err = upload(c, uploadURL, name, photo, size, a, progress)
+	return photoID, err
+}
+
+// Safety levels of photos.  See
+// http://www.flickr.com/services/api/upload.api.html.
+const (
+	SafetySafe       = 1
+	SafetyModerate   = 2
+	SafetyRestricted = 3
+)
+
+// Content types of photos.
+const (
+	ContentPhoto      = 1
+	ContentScreenshot = 2
+	ContentOther      = 3
+)
+
+// Options for uploading a photo; see
+// http://www.flickr.com/services/api/upload.api.html.  Zero values leave
+// the corresponding setting to the user's account defaults, and make the
+// upload asynchronous, like Upload.  A nil *UploadOptions means the same as
+// the zero value wherever one is accepted.
+type UploadOptions struct {
+	Title       string
+	Description string
+
+	// Tags for the photo; tags with spaces in them are quoted as needed.
+	Tags []string
+
+	// Who can see the photo; use Bool to set these.
+	IsPublic *bool
+	IsFriend *bool
+	IsFamily *bool
+
+	// One of SafetySafe, SafetyModerate and SafetyRestricted.
+	SafetyLevel int
+
+	// One of ContentPhoto, ContentScreenshot and ContentOther.
+	ContentType int
+
+	// Whether to hide the photo from public searches; use Bool to set this.
+	Hidden *bool
+
+	// Whether Flickr should process the photo before responding, in which
+	// case UploadWithOptions returns the photo ID instead of a ticket ID.
+	Sync bool
+
+	// Called as the photo is being sent, if not nil.  Not sent to Flickr.
+	Progress ProgressFunc
+}
+
+// Returns a pointer to b, for setting the optional fields of UploadOptions.
+func Bool(b bool) *bool {
+	return &b
+}
+
+// Returns the upload arguments for o.  Useful for passing o to the methods
+// that take the arguments as a map, like Upload.
+func (o *UploadOptions) Args() map[string]string {
+	args := make(map[string]string)
+	set := func(k, v string) {
+		if v != "" {
+			args[k] = v
+		}
+	}
+	flag := func(k string, b *bool, yes, no string) {
+		if b != nil && *b {
+			args[k] = yes
+		} else if b != nil {
+			args[k] = no
+		}
+	}
+	set("title", o.Title)
+	set("description", o.Description)
+	set("tags", joinTags(o.Tags))
+	flag("is_public", o.IsPublic, "1", "0")
+	flag("is_friend", o.IsFriend, "1", "0")
+	flag("is_family", o.IsFamily, "1", "0")
+	if o.SafetyLevel != 0 {
+		args["safety_level"] = strconv.Itoa(o.SafetyLevel)
+	}
+	if o.ContentType != 0 {
+		args["content_type"] = strconv.Itoa(o.ContentType)
+	}
+	flag("hidden", o.Hidden, "2", "1")
+	flag("async", &o.Sync, "0", "1")
+	return args
+}
+
+// Outcome of an upload.
+type UploadResult struct {
+	// Ticket ID of an asynchronous upload; see CheckTickets and
+	// WaitForTickets.
+	TicketID string
+
+	// ID of the new photo, for synchronous uploads.
+	PhotoID string
+}
+
+// Uploads a photo with the given options.  photo and size are as in
+// UploadReader.  opts may be nil.
+func (c *Client) UploadWithOptions(name string, photo io.Reader, size int64,
+	opts *UploadOptions) (*UploadResult, error) {
+	if opts == nil {
+		opts = &UploadOptions{}
+	}
+	ticketID, photoID, err := upload(c, uploadURL, name, photo, size, opts.Args(), opts.Progress)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadResult{TicketID: ticketID, PhotoID: photoID}, nil
+}
+
+// Replaces the image of an existing photo, keeping its title, comments,
+// favourites, set memberships and other metadata.  photo and size are as in
+// UploadReader, and progress as in UploadWithProgress.  If async is true, the
+// photo is processed asynchronously and the result has the ticket ID;
+// otherwise the result has the photo ID.  See
+// http://www.flickr.com/services/api/replace.api.html for details.
+func (c *Client) Replace(photoID string, name string, photo io.Reader, size int64,
+	async bool, progress ProgressFunc) (*UploadResult, error) {
+	args := map[string]string{"photo_id": photoID, "async": "0"}
+	if async {
+		args["async"] = "1"
+	}
+	ticketID, newPhotoID, err := upload(c, replaceURL, name, photo, size, args, progress)
+	if err != nil {
+		return nil, err
+	}
+	return &UploadResult{TicketID: ticketID, PhotoID: newPhotoID}, nil
+}
+
+// Posts a photo to endpoint (uploadURL or replaceURL) and returns the ticket ID
+// (for asynchronous uploads) or the photo ID (for synchronous ones) in the
+// response.
+func upload(c *Client, endpoint string, name string, photo io.Reader, size int64,
+	args map[string]string, progress ProgressFunc) (ticketID, photoID string, err error) {
+	req, uErr := multipartRequest(c, endpoint, name, photo, size, args, progress)
 	if uErr != nil {
-		return "", wrapErr("request creation failed", uErr)
+		return "", "", wrapErr("request creation failed", uErr)
 	}
 
 	resp := struct {
-		Stat     string      `xml:"stat,attr"`
-		Err      flickrError `xml:"err"`
-		TicketID string      `xml:"ticketid"`
+		TicketID string `xml:"ticketid"`
+		PhotoID  string `xml:"photoid"`
 	}{}
 	if err := flickrPost(c, req, &resp); err != nil {
-		return "", wrapErr("uploading failed", err)
-	}
-	if resp.Stat != "ok" {
-		return "", resp.Err.Err()
+		return "", "", wrapErr("uploading failed", err)
 	}
-	return resp.TicketID, nil
+	return resp.TicketID, resp.PhotoID, nil
 }
 
 // Returns URL for flickr.photos.upload.checkTickets request.
@@ -175,10 +470,10 @@ func checkTicketsURL(c *Client, tickets []string) string {
 
 // Asynchronous photo upload status response.
 type TicketStatus struct {
-	ID       string `xml:"id,attr"`
-	Complete string `xml:"complete,attr"`
-	Invalid  string `xml:"invalid,attr"`
-	PhotoID  string `xml:"photoid,attr"`
+	ID       string `xml:"id,attr" json:"id"`
+	Complete string `xml:"complete,attr" json:"complete"`
+	Invalid  string `xml:"invalid,attr" json:"invalid"`
+	PhotoID  string `xml:"photoid,attr" json:"photoid"`
 }
 
 // Checks the status of async upload tickets (returned by Upload method, for
@@ -187,17 +482,16 @@ type TicketStatus struct {
 // API method.
 func (c *Client) CheckTickets(tickets []string) (statuses []TicketStatus, err error) {
 	r := struct {
-		Stat    string         `xml:"stat,attr"`
-		Err     flickrError    `xml:"err"`
-		Tickets []TicketStatus `xml:"uploader>ticket"`
+		Uploader struct {
+			Tickets []TicketStatus `xml:"ticket" json:"ticket"`
+		} `xml:"uploader" json:"uploader"`
 	}{}
-	if err := flickrGet(c, checkTicketsURL(c, tickets), &r); err != nil {
+	if err := flickrGet(c, true, func() string {
+		return checkTicketsURL(c, tickets)
+	}, &r); err != nil {
 		return nil, err
 	}
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
-	return r.Tickets, nil
+	return r.Uploader.Tickets, nil
 }
 
 // Returns URL for flickr.photosets.getList request.
@@ -210,39 +504,165 @@ func getPhotoSetsURL(c *Client, userID string) string {
 // Returns the list of photo sets of the specified user.
 func (c *Client) GetSets(userID string) ([]PhotoSet, error) {
 	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Err  flickrError `xml:"err"`
-		Sets []PhotoSet  `xml:"photosets>photoset"`
+		Sets struct {
+			Sets []PhotoSet `xml:"photoset" json:"photoset"`
+		} `xml:"photosets" json:"photosets"`
 	}{}
-	if err := flickrGet(c, getPhotoSetsURL(c, userID), &r); err != nil {
+	if err := flickrGet(c, true, func() string {
+		return getPhotoSetsURL(c, userID)
+	}, &r); err != nil {
 		return nil, err
 	}
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
+	return r.Sets.Sets, nil
+}
+
+// Adds a photo to a photoset.
+func (c *Client) AddPhotoToSet(photoID, setID string) error {
+	args := make(map[string]string)
+	args["photo_id"] = photoID
+	args["photoset_id"] = setID
+	return flickrPostForm(c, true, "flickr.photosets.addPhoto", args, &struct{}{})
+}
+
+// Creates a photoset containing the photo primaryPhotoID, which becomes its
+// primary photo.  Interface for
+// http://www.flickr.com/services/api/flickr.photosets.create.html
+func (c *Client) CreateSet(title, description, primaryPhotoID string) (*PhotoSet, error) {
+	r := struct {
+		Set PhotoSet `xml:"photoset" json:"photoset"`
+	}{}
+	args := make(map[string]string)
+	args["title"] = title
+	args["description"] = description
+	args["primary_photo_id"] = primaryPhotoID
+	// Not idempotent: repeating a request that reached Flickr creates a
+	// duplicate set.
+	if err := flickrPostForm(c, false, "flickr.photosets.create", args, &r); err != nil {
+		return nil, err
 	}
-	return r.Sets, nil
+	r.Set.Title = title
+	r.Set.Description = description
+	return &r.Set, nil
 }
 
-func addToSetURL(c *Client, photoID, setID string) string {
+// Deletes a photoset; its photos are not deleted.
+func (c *Client) DeleteSet(setID string) error {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	return flickrPostForm(c, true, "flickr.photosets.delete", args, &struct{}{})
+}
+
+// Sets the title and description of a photoset.
+func (c *Client) EditSetMeta(setID, title, description string) error {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	args["title"] = title
+	args["description"] = description
+	return flickrPostForm(c, true, "flickr.photosets.editMeta", args, &struct{}{})
+}
+
+// Replaces the photos of a photoset with photoIDs, in that order.
+// primaryPhotoID must be one of photoIDs.
+func (c *Client) EditSetPhotos(setID, primaryPhotoID string, photoIDs []string) error {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	args["primary_photo_id"] = primaryPhotoID
+	args["photo_ids"] = strings.Join(photoIDs, ",")
+	return flickrPostForm(c, true, "flickr.photosets.editPhotos", args, &struct{}{})
+}
+
+// Removes a photo from a photoset.
+func (c *Client) RemovePhotoFromSet(photoID, setID string) error {
 	args := make(map[string]string)
 	args["photo_id"] = photoID
 	args["photoset_id"] = setID
-	return makeURL(c, "flickr.photosets.addPhoto", args, true)
+	return flickrPostForm(c, true, "flickr.photosets.removePhoto", args, &struct{}{})
 }
 
-// Adds a photo to a photoset.
-func (c *Client) AddPhotoToSet(photoID, setID string) error {
+// Removes several photos from a photoset.
+func (c *Client) RemovePhotosFromSet(setID string, photoIDs []string) error {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	args["photo_ids"] = strings.Join(photoIDs, ",")
+	return flickrPostForm(c, true, "flickr.photosets.removePhotos", args, &struct{}{})
+}
+
+// Moves photoIDs to the start of a photoset, in that order; the other photos
+// of the set follow them in their current order.
+func (c *Client) ReorderSetPhotos(setID string, photoIDs []string) error {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	args["photo_ids"] = strings.Join(photoIDs, ",")
+	return flickrPostForm(c, true, "flickr.photosets.reorderPhotos", args, &struct{}{})
+}
+
+// Makes a photo of a photoset its primary photo.
+func (c *Client) SetPrimaryPhoto(setID, photoID string) error {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	args["photo_id"] = photoID
+	return flickrPostForm(c, true, "flickr.photosets.setPrimaryPhoto", args, &struct{}{})
+}
+
+// Moves setIDs to the start of the authenticated user's list of photosets, in
+// that order.
+func (c *Client) OrderSets(setIDs []string) error {
+	args := make(map[string]string)
+	args["photoset_ids"] = strings.Join(setIDs, ",")
+	return flickrPostForm(c, true, "flickr.photosets.orderSets", args, &struct{}{})
+}
+
+func getSetInfoURL(c *Client, setID string) string {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	return makeURL(c, "flickr.photosets.getInfo", args, true)
+}
+
+// Returns the details of a photoset.  Interface for
+// http://www.flickr.com/services/api/flickr.photosets.getInfo.html
+func (c *Client) GetSetInfo(setID string) (*PhotoSet, error) {
 	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Err  flickrError `xml:"err"`
+		Set PhotoSet `xml:"photoset" json:"photoset"`
 	}{}
-	if err := flickrGet(c, addToSetURL(c, photoID, setID), &r); err != nil {
-		return err
+	if err := flickrGet(c, true, func() string {
+		return getSetInfoURL(c, setID)
+	}, &r); err != nil {
+		return nil, err
+	}
+	return &r.Set, nil
+}
+
+func getSetPhotosURL(c *Client, setID string, page, perPage int, extras []string) string {
+	args := make(map[string]string)
+	args["photoset_id"] = setID
+	if page > 0 {
+		args["page"] = strconv.Itoa(page)
+	}
+	if perPage > 0 {
+		args["per_page"] = strconv.Itoa(perPage)
 	}
-	if r.Stat != "ok" {
-		return r.Err.Err()
+	if len(extras) > 0 {
+		args["extras"] = strings.Join(extras, ",")
+	}
+	return makeURL(c, "flickr.photosets.getPhotos", args, true)
+}
+
+// Returns a page of the photos in a photoset.  page starts from 1, and
+// perPage can be up to 500; 0 means Flickr's default for either.  extras
+// names the additional fields to return for each photo, like "date_taken" or
+// "url_m".  Interface for
+// http://www.flickr.com/services/api/flickr.photosets.getPhotos.html
+func (c *Client) GetSetPhotos(setID string, page, perPage int,
+	extras []string) (*SetPhotosResponse, error) {
+	r := struct {
+		Set SetPhotosResponse `xml:"photoset" json:"photoset"`
+	}{}
+	if err := flickrGet(c, true, func() string {
+		return getSetPhotosURL(c, setID, page, perPage, extras)
+	}, &r); err != nil {
+		return nil, err
 	}
-	return nil
+	return &r.Set, nil
 }
 
 func getLocationURL(c *Client, args map[string]string) string {
@@ -253,19 +673,250 @@ func getLocationURL(c *Client, args map[string]string) string {
 // Implements https://www.flickr.com/services/api/flickr.photos.geo.getLocation.html
 func (c *Client) GetLocation(args map[string]string) (*LocationResponse, error) {
 	r := struct {
-		Stat     string           `xml:"stat,attr"`
-		Err      flickrError      `xml:"err"`
-		Location LocationResponse `xml:"photo"`
+		Location LocationResponse `xml:"photo" json:"photo"`
 	}{}
-	if err := flickrGet(c, getLocationURL(c, args), &r); err != nil {
+	if err := flickrGet(c, true, func() string {
+		return getLocationURL(c, args)
+	}, &r); err != nil {
 		return nil, err
 	}
 
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
+	return &r.Location, nil
+}
+
+func getSizesURL(c *Client, photoID string) string {
+	args := make(map[string]string)
+	args["photo_id"] = photoID
+	return makeURL(c, "flickr.photos.getSizes", args, true)
+}
+
+// Returns the sizes in which a photo or video is available, smallest first.
+// Interface for http://www.flickr.com/services/api/flickr.photos.getSizes.html
+func (c *Client) GetSizes(photoID string) ([]Size, error) {
+	r := struct {
+		Sizes struct {
+			Sizes []Size `xml:"size" json:"size"`
+		} `xml:"sizes" json:"sizes"`
+	}{}
+	if err := flickrGet(c, true, func() string {
+		return getSizesURL(c, photoID)
+	}, &r); err != nil {
+		return nil, err
 	}
+	return r.Sizes.Sizes, nil
+}
 
-	return &r.Location, nil
+func getExifURL(c *Client, photoID string) string {
+	args := make(map[string]string)
+	args["photo_id"] = photoID
+	return makeURL(c, "flickr.photos.getExif", args, true)
+}
+
+// Returns the EXIF, IPTC and XMP metadata of a photo.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.getExif.html
+func (c *Client) GetExif(photoID string) (*Exif, error) {
+	r := struct {
+		Photo Exif `xml:"photo" json:"photo"`
+	}{}
+	if err := flickrGet(c, true, func() string {
+		return getExifURL(c, photoID)
+	}, &r); err != nil {
+		return nil, err
+	}
+	return &r.Photo, nil
+}
+
+func getPhotoInfoURL(c *Client, photoID string) string {
+	args := make(map[string]string)
+	args["photo_id"] = photoID
+	return makeURL(c, "flickr.photos.getInfo", args, true)
+}
+
+// Returns detailed information about a photo.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.getInfo.html
+func (c *Client) GetPhotoInfo(photoID string) (*PhotoInfo, error) {
+	r := struct {
+		Photo PhotoInfo `xml:"photo" json:"photo"`
+	}{}
+	if err := flickrGet(c, true, func() string {
+		return getPhotoInfoURL(c, photoID)
+	}, &r); err != nil {
+		return nil, err
+	}
+	return &r.Photo, nil
+}
+
+// Sets the title and description of a photo.  Requires write permission.
+// Interface for http://www.flickr.com/services/api/flickr.photos.setMeta.html
+func (c *Client) SetMeta(photoID, title, description string) error {
+	args := map[string]string{
+		"photo_id":    photoID,
+		"title":       title,
+		"description": description,
+	}
+	return flickrPostForm(c, true, "flickr.photos.setMeta", args, &struct{}{})
+}
+
+// Format of dates taken in Flickr API requests.
+const dateTakenFormat = "2006-01-02 15:04:05"
+
+// Sets the dates a photo was posted and taken; zero times are left
+// unchanged.  takenGranularity is one of the Granularity* constants, or
+// empty to leave it unchanged.  Requires write permission.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.setDates.html
+func (c *Client) SetDates(photoID string, posted, taken time.Time,
+	takenGranularity string) error {
+	args := map[string]string{"photo_id": photoID}
+	if !posted.IsZero() {
+		args["date_posted"] = strconv.FormatInt(posted.Unix(), 10)
+	}
+	if !taken.IsZero() {
+		args["date_taken"] = taken.Format(dateTakenFormat)
+	}
+	if takenGranularity != "" {
+		args["date_taken_granularity"] = takenGranularity
+	}
+	return flickrPostForm(c, true, "flickr.photos.setDates", args, &struct{}{})
+}
+
+// Sets the content type of a photo to one of the Content* constants.
+// Requires write permission.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.setContentType.html
+func (c *Client) SetContentType(photoID string, contentType int) error {
+	args := map[string]string{
+		"photo_id":     photoID,
+		"content_type": strconv.Itoa(contentType),
+	}
+	return flickrPostForm(c, true, "flickr.photos.setContentType", args, &struct{}{})
+}
+
+// Sets the safety level of a photo to one of the Safety* constants, and
+// whether it is hidden from public searches.  A safetyLevel of 0 or a nil
+// hidden leaves the respective setting unchanged.  Requires write
+// permission.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.setSafetyLevel.html
+func (c *Client) SetSafetyLevel(photoID string, safetyLevel int, hidden *bool) error {
+	args := map[string]string{"photo_id": photoID}
+	if safetyLevel != 0 {
+		args["safety_level"] = strconv.Itoa(safetyLevel)
+	}
+	if hidden != nil {
+		args["hidden"] = "0"
+		if *hidden {
+			args["hidden"] = "1"
+		}
+	}
+	return flickrPostForm(c, true, "flickr.photos.setSafetyLevel", args, &struct{}{})
+}
+
+// Licenses that can be set with SetLicense.  See
+// http://www.flickr.com/services/api/flickr.photos.licenses.getInfo.html
+const (
+	LicenseAllRightsReserved   = 0
+	LicenseCCByNCSA            = 1
+	LicenseCCByNC              = 2
+	LicenseCCByNCND            = 3
+	LicenseCCBy                = 4
+	LicenseCCBySA              = 5
+	LicenseCCByND              = 6
+	LicenseNoKnownRestrictions = 7
+	LicenseUSGovernmentWork    = 8
+	LicenseCC0                 = 9
+	LicensePublicDomainMark    = 10
+)
+
+// Sets the license of a photo to one of the License* constants.  Requires
+// write permission.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.licenses.setLicense.html
+func (c *Client) SetLicense(photoID string, licenseID int) error {
+	args := map[string]string{
+		"photo_id":   photoID,
+		"license_id": strconv.Itoa(licenseID),
+	}
+	return flickrPostForm(c, true, "flickr.photos.licenses.setLicense", args, &struct{}{})
+}
+
+// Adds tags to a photo.  Tags containing spaces, including machine tags like
+// "dc:title=My cat", are quoted as Flickr requires.  Requires write
+// permission.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.addTags.html
+func (c *Client) AddTags(photoID string, tags []string) error {
+	args := map[string]string{
+		"photo_id": photoID,
+		"tags":     joinTags(tags),
+	}
+	return flickrPostForm(c, true, "flickr.photos.addTags", args, &struct{}{})
+}
+
+// Replaces the tags of a photo with tags, quoted as by AddTags.  Requires
+// write permission.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.setTags.html
+func (c *Client) SetTags(photoID string, tags []string) error {
+	args := map[string]string{
+		"photo_id": photoID,
+		"tags":     joinTags(tags),
+	}
+	return flickrPostForm(c, true, "flickr.photos.setTags", args, &struct{}{})
+}
+
+// Removes a tag from a photo; tagID is the ID of a Tag returned by
+// GetPhotoInfo.  Requires write permission.  Interface for
+// http://www.flickr.com/services/api/flickr.photos.removeTag.html
+func (c *Client) RemoveTag(tagID string) error {
+	args := map[string]string{"tag_id": tagID}
+	return flickrPostForm(c, true, "flickr.photos.removeTag", args, &struct{}{})
+}
+
+// Returns the key by which tag t is compared with other tags.  Flickr tags
+// are case insensitive, and quotes are dropped by joinTags.
+func tagKey(t string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Replace(t, `"`, "", -1)))
+}
+
+// Changes the tags of a photo to tags, by removing the photo's tags that are
+// not in tags and adding the ones in tags that the photo does not have.
+// Unlike SetTags, this leaves the tags the photo keeps untouched, along with
+// their authors.  Returns the tags added and the IDs of the tags removed; on
+// failure, the changes made before it.  Requires write permission.
+func (c *Client) ApplyTags(photoID string, tags []string) (added, removed []string, err error) {
+	info, err := c.GetPhotoInfo(photoID)
+	if err != nil {
+		return nil, nil, wrapErr("getting current tags failed", err)
+	}
+	want := make(map[string]bool)
+	for _, t := range tags {
+		if k := tagKey(t); k != "" && !want[k] {
+			want[k] = true
+			added = append(added, t)
+		}
+	}
+	have := make(map[string]bool)
+	for _, t := range info.Tags {
+		k := tagKey(t.Raw)
+		have[k] = true
+		if !want[k] {
+			removed = append(removed, t.ID)
+		}
+	}
+	toAdd := added[:0]
+	for _, t := range added {
+		if !have[tagKey(t)] {
+			toAdd = append(toAdd, t)
+		}
+	}
+	added = toAdd
+
+	for i, id := range removed {
+		if err := c.RemoveTag(id); err != nil {
+			return nil, removed[:i], wrapErr("removing tag failed", err)
+		}
+	}
+	if len(added) > 0 {
+		if err := c.AddTags(photoID, added); err != nil {
+			return nil, removed, wrapErr("adding tags failed", err)
+		}
+	}
+	return added, removed, nil
 }
 
 func getPeopleInfoURL(c *Client, args map[string]string) string {
@@ -276,18 +927,14 @@ func getPeopleInfoURL(c *Client, args map[string]string) string {
 // Implements https://www.flickr.com/services/api/flickr.people.getInfo.html
 func (c *Client) GetPeopleInfo(args map[string]string) (*PersonResponse, error) {
 	r := struct {
-		Stat   string         `xml:"stat,attr"`
-		Err    flickrError    `xml:"err"`
-		Person PersonResponse `xml:"person"`
+		Person PersonResponse `xml:"person" json:"person"`
 	}{}
-	if err := flickrGet(c, getPeopleInfoURL(c, args), &r); err != nil {
+	if err := flickrGet(c, true, func() string {
+		return getPeopleInfoURL(c, args)
+	}, &r); err != nil {
 		return nil, err
 	}
 
-	if r.Stat != "ok" {
-		return nil, r.Err.Err()
-	}
-
 	return &r.Person, nil
 }
 
@@ -298,18 +945,9 @@ func pushSubscribeURL(c *Client, args map[string]string) string {
 
 // Implements https://api.flickr.com/services/rest/?method=flickr.push.subscribe
 func (c *Client) PushSubscribe(args map[string]string) error {
-	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Err  flickrError `xml:"err"`
-	}{}
-	if err := flickrGet(c, pushSubscribeURL(c, args), &r); err != nil {
-		return err
-	}
-	if r.Stat != "ok" {
-		return r.Err.Err()
-	}
-
-	return nil
+	return flickrGet(c, true, func() string {
+		return pushSubscribeURL(c, args)
+	}, &struct{}{})
 }
 
 func getFrobURL(c *Client) string {
@@ -319,16 +957,11 @@ func getFrobURL(c *Client) string {
 // Implements https://www.flickr.com/services/api/flickr.auth.getFrob.html
 func (c *Client) GetFrob() (string, error) {
 	r := struct {
-		Stat string      `xml:"stat,attr"`
-		Frob string      `xml:"frob"`
-		Err  flickrError `xml:"err"`
+		Frob string `xml:"frob" json:"frob"`
 	}{}
-	if err := flickrGet(c, getFrobURL(c), &r); err != nil {
+	if err := flickrGet(c, true, func() string { return getFrobURL(c) }, &r); err != nil {
 		return "", err
 	}
-	if r.Stat != "ok" {
-		return "", r.Err.Err()
-	}
 
 	return r.Frob, nil
 }
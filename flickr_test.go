@@ -2,7 +2,12 @@ package flickgo
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
@@ -10,9 +15,14 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
@@ -123,11 +133,27 @@ func (f fakeRoundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
 	return f.getFn(r)
 }
 
+// Start of a JPEG file, and a short photo starting with it; test photos need
+// real JPEG data to be detected as such.
+const (
+	jpegHead  = "\xff\xd8\xff\xe0\x00\x10JFIF\x00"
+	jpegPhoto = jpegHead + "photo"
+)
+
 func newHTTPClient(getFn func(*http.Request) (*http.Response, error)) *http.Client {
 	rt := fakeRoundTripper{getFn: getFn}
 	return &http.Client{Transport: rt}
 }
 
+// Returns a Client that sends its requests with httpClient.  It has no
+// Limiter, so that tests do not depend on the calls made by other tests
+// through the shared limiter.
+func newClient(httpClient *http.Client) *Client {
+	c := New(apiKey, secret, httpClient)
+	c.Limiter = nil
+	return c
+}
+
 func TestFetchHttpGetFails(t *testing.T) {
 	url_ := "http://some.url/?arg=value"
 	err := errors.New("random error")
@@ -135,11 +161,11 @@ func TestFetchHttpGetFails(t *testing.T) {
 		assertEq(t, "url", url_, r.URL.String())
 		return nil, err
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 
 	resp, e := fetch(c, url_)
 	assert(t, "resp", resp == nil)
-	assertEq(t, "err", fmt.Sprintf("GET failed: Get %s: %s", url_, err), e.Error())
+	assertEq(t, "err", fmt.Sprintf("GET failed: Get %q: %s", url_, err), e.Error())
 }
 
 func TestFetchSuccess(t *testing.T) {
@@ -153,7 +179,7 @@ func TestFetchSuccess(t *testing.T) {
 		assertEq(t, "url", url_, r.URL.String())
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 
 	in, e := fetch(c, url_)
 	assertOK(t, "fetch", e)
@@ -164,17 +190,18 @@ func TestFetchSuccess(t *testing.T) {
 }
 
 func TestUploadRequest(t *testing.T) {
-	data := []byte("123456\n78910\nasdfoiu\nasdfeejh")
+	data := []byte(jpegHead + "123456\n78910\nasdfoiu\nasdfeejh")
 	filename := "kitten.JPEG"
 	args := map[string]string{
 		"title":       "kitten",
 		"description": "my cute kitten",
 	}
 	authToken := "ase878723623"
-	c := New(apiKey, secret, nil)
+	c := newClient(nil)
 	c.AuthToken = authToken
-	req, rqErr := uploadRequest(c, filename, data, args)
-	assertOK(t, "uploadRequest", rqErr)
+	req, rqErr := multipartRequest(c, uploadURL, filename, bytes.NewReader(data),
+		int64(len(data)), args, nil)
+	assertOK(t, "multipartRequest", rqErr)
 	pErr := req.ParseMultipartForm(128)
 	assertOK(t, "parseForm", pErr)
 
@@ -208,11 +235,242 @@ func TestUploadRequest(t *testing.T) {
 	assertEq(t, "photo", string(data), string(actual))
 }
 
+type ctxKey struct{}
+
+func TestFetchWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "v"))
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "ctx value", "v", r.Context().Value(ctxKey{}))
+		if err := r.Context().Err(); err != nil {
+			return nil, err
+		}
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	_, e := fetch(c.WithContext(ctx), "http://some.url/")
+	assertOK(t, "fetch", e)
+
+	cancel()
+	_, e = fetch(c.WithContext(ctx), "http://some.url/")
+	assert(t, "cancelled", errors.Is(e, context.Canceled))
+	assert(t, "original client", c.Context() == context.Background())
+}
+
+func TestUploadWithContext(t *testing.T) {
+	ctx := context.WithValue(context.Background(), ctxKey{}, "v")
+	postFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "ctx value", "v", r.Context().Value(ctxKey{}))
+		xmlStr := `<rsp stat="ok"><ticketid>363</ticketid></rsp>`
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn)).WithContext(ctx)
+	ticket, err := c.Upload("kitten.jpg", []byte(jpegPhoto), map[string]string{})
+	assertOK(t, "upload", err)
+	assertEq(t, "ticket", "363", ticket)
+}
+
+func TestNormalizeJSON(t *testing.T) {
+	n := normalizeJSON(map[string]interface{}{
+		"title": map[string]interface{}{"_content": "Flowers"},
+		"tag": []interface{}{
+			map[string]interface{}{"raw": "a b", "_content": "ab"},
+		},
+		"farm":   json.Number("3"),
+		"public": true,
+	}).(map[string]interface{})
+	assertEq(t, "title", "Flowers", n["title"])
+	assertEq(t, "tag", "ab", n["tag"].([]interface{})[0].(map[string]interface{})["_content"])
+	assertEq(t, "farm", "3", n["farm"])
+	assertEq(t, "public", "1", n["public"])
+}
+
+func TestMakeURLJSON(t *testing.T) {
+	c := newClient(nil)
+	c.Format = FormatJSON
+	u, uErr := url.Parse(makeURL(c, "flickr.photos.search", map[string]string{}, true))
+	assertOK(t, "parseURL", uErr)
+	a := u.Query()
+	assertEq(t, "format", "json", a.Get("format"))
+	assertEq(t, "nojsoncallback", "1", a.Get("nojsoncallback"))
+	assertEq(t, "api_sig", 1, len(a["api_sig"]))
+}
+
+func TestParseJSONError(t *testing.T) {
+	jsonStr := `{"stat": "fail", "code": 96, "message": "Invalid signature"}`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(jsonStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.Format = FormatJSON
+	_, err := c.GetSets("me")
+	var fErr *Error
+	assert(t, "errors.As", errors.As(err, &fErr))
+	assertEq(t, "code", 96, fErr.Code)
+	assertEq(t, "message", "Invalid signature", fErr.Message)
+	assertEq(t, "method", "flickr.photosets.getList", fErr.Method)
+}
+
+// Reader that produces n bytes without holding them in memory.  Deliberately
+// not an io.Seeker.
+type zeroReader struct {
+	n int64
+}
+
+func (r *zeroReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	r.n -= int64(len(p))
+	return len(p), nil
+}
+
+func TestUploadRequestStreaming(t *testing.T) {
+	c := newClient(nil)
+	size := int64(5 * 1024 * 1024)
+	req, rqErr := multipartRequest(c, uploadURL, "video.mp4", &zeroReader{n: size}, size,
+		map[string]string{"title": "video"}, nil)
+	assertOK(t, "multipartRequest", rqErr)
+	assert(t, "GetBody", req.GetBody == nil)
+	var cw countingWriter
+	_, cErr := io.Copy(&cw, req.Body)
+	assertOK(t, "copy", cErr)
+	assertEq(t, "content length", req.ContentLength, int64(cw))
+	assert(t, "includes photo", int64(cw) > size)
+
+	req, rqErr = multipartRequest(c, uploadURL, "video.mp4", &zeroReader{n: 10}, -1,
+		map[string]string{}, nil)
+	assertOK(t, "multipartRequest unknown size", rqErr)
+	assertEq(t, "unknown content length", int64(-1), req.ContentLength)
+	req.Body.Close()
+}
+
+func TestUploadRequestRewind(t *testing.T) {
+	c := newClient(nil)
+	data := jpegHead + "photo data"
+	photo := strings.NewReader("xx" + data)
+	photo.Seek(2, io.SeekStart)
+	req, rqErr := multipartRequest(c, uploadURL, "kitten.jpg", photo, int64(len(data)),
+		map[string]string{}, nil)
+	assertOK(t, "multipartRequest", rqErr)
+	first, _ := ioutil.ReadAll(req.Body)
+	body, gErr := req.GetBody()
+	assertOK(t, "GetBody", gErr)
+	second, _ := ioutil.ReadAll(body)
+	assertEq(t, "length", req.ContentLength, int64(len(first)))
+	assertEq(t, "same body", string(first), string(second))
+	assert(t, "photo data", strings.Contains(string(second), "\r\n\r\n"+data+"\r\n"))
+}
+
+func TestUploadRequestRewindUnfinished(t *testing.T) {
+	c := newClient(nil)
+	data := jpegHead + strings.Repeat("photo data", 100000)
+	var mu sync.Mutex
+	var sent []int64
+	progress := func(s, total int64) {
+		mu.Lock()
+		sent = append(sent, s)
+		mu.Unlock()
+	}
+	req, rqErr := multipartRequest(c, uploadURL, "kitten.jpg", strings.NewReader(data),
+		int64(len(data)), map[string]string{}, progress)
+	assertOK(t, "multipartRequest", rqErr)
+	// The first attempt is abandoned after reading only part of the body.
+	io.ReadFull(req.Body, make([]byte, 100))
+	body, gErr := req.GetBody()
+	assertOK(t, "GetBody", gErr)
+	mu.Lock()
+	sent = nil
+	mu.Unlock()
+	second, _ := ioutil.ReadAll(body)
+	assertEq(t, "length", req.ContentLength, int64(len(second)))
+	assert(t, "photo data", strings.Contains(string(second), "\r\n\r\n"+data+"\r\n"))
+	mu.Lock()
+	defer mu.Unlock()
+	for i := 1; i < len(sent); i++ {
+		assert(t, "progress increases", sent[i] >= sent[i-1])
+	}
+	assertEq(t, "progress done", int64(len(data)), sent[len(sent)-1])
+}
+
+func TestJoinTags(t *testing.T) {
+	tags := []string{"kitten", "new york", `say "cheese"`, " ", "geo:lat=12.34",
+		"dc:title=My cat"}
+	assertEq(t, "tags", `kitten "new york" "say cheese" geo:lat=12.34 "dc:title=My cat"`,
+		joinTags(tags))
+	assertEq(t, "empty", "", joinTags(nil))
+}
+
+// Returns an HTTP client that stores the form of POST requests in form, and
+// responds with an empty success response.
+func newFormClient(t *testing.T, form *url.Values) *http.Client {
+	return newHTTPClient(func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "http method", "POST", r.Method)
+		assertEq(t, "url", service+"/rest/", r.URL.String())
+		assertEq(t, "content type", "application/x-www-form-urlencoded",
+			r.Header.Get("Content-Type"))
+		assertOK(t, "ParseForm", r.ParseForm())
+		*form = r.PostForm
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(`<rsp stat="ok"/>`))}, nil
+	})
+}
+
+func TestFlickrPostForm(t *testing.T) {
+	var form url.Values
+	c := newClient(newFormClient(t, &form))
+	c.AuthToken = "token"
+	err := flickrPostForm(c, true, "flickr.test.echo", map[string]string{"a": "b c"}, &struct{}{})
+	assertOK(t, "flickrPostForm", err)
+	assertEq(t, "method", "flickr.test.echo", form.Get("method"))
+	assertEq(t, "a", "b c", form.Get("a"))
+	assertEq(t, "api_sig", sign(secret, map[string]string{
+		"method":     "flickr.test.echo",
+		"a":          "b c",
+		"api_key":    apiKey,
+		"auth_token": "token",
+	}), form.Get("api_sig"))
+}
+
+func TestFlickrPostFormOAuth(t *testing.T) {
+	defer fixOAuthParams()()
+	var form url.Values
+	c := newClient(newFormClient(t, &form))
+	c.OAuthToken, c.OAuthTokenSecret = "tok", "toksecret"
+	err := flickrPostForm(c, true, "flickr.test.echo", map[string]string{"a": "b"}, &struct{}{})
+	assertOK(t, "flickrPostForm", err)
+	args := make(map[string]string)
+	for k := range form {
+		args[k] = form.Get(k)
+	}
+	sig := args["oauth_signature"]
+	delete(args, "oauth_signature")
+	assertEq(t, "oauth_token", "tok", args["oauth_token"])
+	assertEq(t, "signature", oauthSign("POST", service+"/rest/", args, secret, "toksecret"), sig)
+}
+
+func TestFlickrPostFormError(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		xmlStr := `<rsp stat="fail"><err code="99" msg="Insufficient permissions"/></rsp>`
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	err := c.SetMeta("1", "title", "")
+	assert(t, "errors.Is", errors.Is(err, ErrInsufficientPermissions))
+	var fErr *Error
+	assert(t, "errors.As", errors.As(err, &fErr))
+	assertEq(t, "method", "flickr.photos.setMeta", fErr.Method)
+}
+
 //-----------------------
 // Tests for flickr.go
 //
 func TestAuthURL(t *testing.T) {
-	c := New(apiKey, secret, nil)
+	c := newClient(nil)
 
 	u, uErr := url.Parse(c.AuthURL(ReadPerm))
 	assertOK(t, "parseURL", uErr)
@@ -230,7 +488,7 @@ func TestAuthURL(t *testing.T) {
 
 func TestGetTokenURL(t *testing.T) {
 	frob := "837cjnei"
-	c := New(apiKey, secret, nil)
+	c := newClient(nil)
 
 	u, uErr := url.Parse(getTokenURL(c, frob))
 	assertOK(t, "parseURL", uErr)
@@ -254,7 +512,7 @@ func TestGetTokenAPIFailure(t *testing.T) {
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 	_, _, err := c.GetToken("878243")
 	assert(t, "err", err != nil)
 	assert(t, "message: "+err.Error(),
@@ -277,7 +535,7 @@ func TestGetToken(t *testing.T) {
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 	tok, user, err := c.GetToken("878243")
 	assertOK(t, "GetToken", err)
 	assertEq(t, "token", "121-84669832774", tok)
@@ -297,8 +555,8 @@ func TestUploadFails(t *testing.T) {
 	postFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(postFn))
-	ticket, err := c.Upload("filename", []byte("photo content"),
+	c := newClient(newHTTPClient(postFn))
+	ticket, err := c.Upload("filename.jpg", []byte(jpegHead+"photo content"),
 		map[string]string{})
 	assert(t, "message: "+err.Error(),
 		strings.Contains(err.Error(), "code 5: Filetype was not recognised"))
@@ -317,8 +575,8 @@ func TestUpload(t *testing.T) {
 	postFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(postFn))
-	ticket, err := c.Upload("filename", make([]byte, 1024*1024),
+	c := newClient(newHTTPClient(postFn))
+	ticket, err := c.Upload("filename.jpg", append([]byte(jpegHead), make([]byte, 1024*1024)...),
 		map[string]string{})
 	assertOK(t, "upload", err)
 	assertEq(t, "ticket", "363", ticket)
@@ -329,7 +587,7 @@ func TestSearchURL(t *testing.T) {
 		"per_page": "10",
 		"user_id":  "me",
 	}
-	c := New(apiKey, secret, nil)
+	c := newClient(nil)
 
 	u, uErr := url.Parse(searchURL(c, args))
 	assertOK(t, "parseURL", uErr)
@@ -361,7 +619,7 @@ func TestSearch(t *testing.T) {
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 	r, err := c.Search(map[string]string{})
 	assertOK(t, "search", err)
 	assertEq(t, "page", "1", r.Page)
@@ -411,7 +669,7 @@ func TestCheckTicketsURL(t *testing.T) {
 		"23232",
 		"65876",
 	}
-	c := New(apiKey, secret, nil)
+	c := newClient(nil)
 	authToken := "ase878723623"
 	c.AuthToken = authToken
 
@@ -439,7 +697,7 @@ func TestCheckTickets(t *testing.T) {
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 	statuses, err := c.CheckTickets([]string{"12345", "56789", "333"})
 	assertOK(t, "checkTickets", err)
 	assertEq(t, "len(statues)", 3, len(statuses))
@@ -458,7 +716,7 @@ func TestCheckTickets(t *testing.T) {
 
 func TestGetPhotoSetsURL(t *testing.T) {
 	userID := "7687633@N01"
-	c := New(apiKey, secret, nil)
+	c := newClient(nil)
 	authToken := "ase878723623"
 	c.AuthToken = authToken
 
@@ -491,7 +749,7 @@ func TestGetSets(t *testing.T) {
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 	sets, err := c.GetSets("me")
 	assertOK(t, "getPhotoSets", err)
 	assertEq(t, "len(sets)", 2, len(sets))
@@ -549,7 +807,7 @@ func TestGetPeopleInfo(t *testing.T) {
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 	authToken := "ase878723623"
 	c.AuthToken = authToken
 
@@ -594,7 +852,7 @@ func TestGetLocation(t *testing.T) {
 	getFn := func(r *http.Request) (*http.Response, error) {
 		return &resp, nil
 	}
-	c := New(apiKey, secret, newHTTPClient(getFn))
+	c := newClient(newHTTPClient(getFn))
 	authToken := "ase878723623"
 	c.AuthToken = authToken
 
@@ -612,3 +870,2009 @@ func TestGetLocation(t *testing.T) {
 	}
 	verify(*r, 17134823816, "40.730892", "-73.997475")
 }
+
+func TestCheckTokenURL(t *testing.T) {
+	c := newClient(nil)
+	c.AuthToken = "ase878723623"
+	u, uErr := url.Parse(checkTokenURL(c))
+	assertOK(t, "parseURL", uErr)
+	assertEq(t, "method", "flickr.auth.checkToken", u.Query().Get("method"))
+	assertEq(t, "auth_token", "ase878723623", u.Query().Get("auth_token"))
+
+	c.OAuthToken = "oauth-token"
+	u, uErr = url.Parse(checkTokenURL(c))
+	assertOK(t, "parseURL", uErr)
+	assertEq(t, "oauth method", "flickr.auth.oauth.checkToken", u.Query().Get("method"))
+	assertEq(t, "oauth_token", "oauth-token", u.Query().Get("oauth_token"))
+}
+
+func TestCheckToken(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
+    <rsp stat="ok">
+      <oauth>
+        <token>72157627611980735-09e87c3024f733da</token>
+        <perms>write</perms>
+        <user nsid="1121451801@N07" username="jamalf" fullname="Jamal F" />
+      </oauth>
+    </rsp>`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.OAuthToken = "72157627611980735-09e87c3024f733da"
+	perms, user, err := c.CheckToken()
+	assertOK(t, "CheckToken", err)
+	assertEq(t, "perms", WritePerm, perms)
+	assertEq(t, "nsid", "1121451801@N07", user.NSID)
+	assertEq(t, "username", "jamalf", user.UserName)
+	assertEq(t, "fullname", "Jamal F", user.FullName)
+}
+
+func TestCheckTokenLegacy(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
+    <rsp stat="ok">
+      <auth>
+        <token>976598454353455</token>
+        <perms>read</perms>
+        <user nsid="12037949754@N01" username="Bees" fullname="Cal H" />
+      </auth>
+    </rsp>`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.AuthToken = "976598454353455"
+	perms, user, err := c.CheckToken()
+	assertOK(t, "CheckToken", err)
+	assertEq(t, "perms", ReadPerm, perms)
+	assertEq(t, "nsid", "12037949754@N01", user.NSID)
+}
+
+func TestCheckTokenInvalid(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
+    <rsp stat="fail">
+      <err code="98" msg="Invalid token"/>
+    </rsp>`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.AuthToken = "976598454353455"
+	_, user, err := c.CheckToken()
+	assert(t, "user", user == nil)
+	assert(t, "err", err != nil && strings.Contains(err.Error(), "code 98"))
+}
+
+func TestCall(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8" ?>
+    <rsp stat="ok">
+      <user id="12037949754@N01">
+        <username>Bees</username>
+      </user>
+    </rsp>`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "http method", "POST", r.Method)
+		assertOK(t, "ParseForm", r.ParseForm())
+		a := r.PostForm
+		assertEq(t, "method", "flickr.test.login", a.Get("method"))
+		assertEq(t, "arg", "value", a.Get("arg"))
+		assertEq(t, "auth_token", "ase878723623", a.Get("auth_token"))
+		assertEq(t, "api_sig", 1, len(a["api_sig"]))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.AuthToken = "ase878723623"
+	r := struct {
+		User struct {
+			ID       string `xml:"id,attr"`
+			UserName string `xml:"username"`
+		} `xml:"user"`
+	}{}
+	err := c.Call("flickr.test.login", map[string]string{"arg": "value"}, true, &r)
+	assertOK(t, "Call", err)
+	assertEq(t, "id", "12037949754@N01", r.User.ID)
+	assertEq(t, "username", "Bees", r.User.UserName)
+}
+
+func TestCallIdempotent(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "http method", "GET", r.Method)
+		assertEq(t, "method", "flickr.test.login", r.URL.Query().Get("method"))
+		assertEq(t, "auth_token", "ase878723623", r.URL.Query().Get("auth_token"))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(`<rsp stat="ok"/>`))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.AuthToken = "ase878723623"
+	assertOK(t, "CallIdempotent", c.CallIdempotent("flickr.test.login", nil, true, nil))
+}
+
+func TestCallFails(t *testing.T) {
+	xmlStr := `<rsp stat="fail"><err code="112" msg="Method &quot;flickr.nope&quot; not found"/></rsp>`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	err := c.Call("flickr.nope", map[string]string{}, false, nil)
+	var fErr *Error
+	assert(t, "errors.As", errors.As(err, &fErr))
+	assertEq(t, "code", 112, fErr.Code)
+	assertEq(t, "method", "flickr.nope", fErr.Method)
+}
+
+func TestSearchJSON(t *testing.T) {
+	jsonStr := `{"photos": {"page": 1, "pages": 3, "perpage": 2, "total": "5",
+      "photo": [
+        {"id": "1234", "owner": "22@N01", "secret": "63562", "server": "3",
+         "farm": 1, "title": "kitten", "ispublic": 0, "width_t": "100",
+         "height_t": "100"},
+        {"id": "5678", "owner": "22@N01", "secret": "36221", "server": "32",
+         "farm": 4, "title": "puppies", "ispublic": 1, "width_t": 120,
+         "height_t": 100}
+      ]}, "stat": "ok"}`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "format", "json", r.URL.Query().Get("format"))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(jsonStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.Format = FormatJSON
+	r, err := c.Search(map[string]string{})
+	assertOK(t, "search", err)
+	assertEq(t, "page", "1", r.Page)
+	assertEq(t, "total", "5", r.Total)
+	assertEq(t, "len photos", 2, len(r.Photos))
+	assertEq(t, "farm", "4", r.Photos[1].Farm)
+	assertEq(t, "ispublic", "1", r.Photos[1].IsPublic)
+	assertEq(t, "ratio", float64(120)/100, r.Photos[1].Ratio)
+}
+
+func TestGetSetsJSON(t *testing.T) {
+	jsonStr := `jsonFlickrApi({"photosets": {"cancreate": 1, "photoset": [
+        {"id": "12345", "photos": 35, "videos": 0,
+         "title": {"_content": "Flowers"},
+         "description": {"_content": "All my flower pictures"}}
+      ]}, "stat": "ok"})`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(jsonStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.Format = FormatJSON
+	sets, err := c.GetSets("me")
+	assertOK(t, "GetSets", err)
+	assertEq(t, "len(sets)", 1, len(sets))
+	assertEq(t, "id", "12345", sets[0].ID)
+	assertEq(t, "title", "Flowers", sets[0].Title)
+	assertEq(t, "description", "All my flower pictures", sets[0].Description)
+}
+
+func TestUploadReader(t *testing.T) {
+	postFn := func(r *http.Request) (*http.Response, error) {
+		assertOK(t, "parseForm", r.ParseMultipartForm(1024))
+		f, _ := r.MultipartForm.File["photo"][0].Open()
+		data, _ := ioutil.ReadAll(f)
+		assertEq(t, "photo", jpegHead+"streamed photo", string(data))
+		xmlStr := `<rsp stat="ok"><ticketid>364</ticketid></rsp>`
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	photo := ioutil.NopCloser(strings.NewReader(jpegHead + "streamed photo"))
+	ticket, err := c.UploadReader("kitten.jpg", photo, -1, map[string]string{})
+	assertOK(t, "UploadReader", err)
+	assertEq(t, "ticket", "364", ticket)
+}
+
+func TestUploadWithProgress(t *testing.T) {
+	size := int64(1024 * 1024)
+	var mu sync.Mutex
+	var sent []int64
+	progress := func(n, total int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		assertEq(t, "total", size, total)
+		sent = append(sent, n)
+	}
+	postFn := func(r *http.Request) (*http.Response, error) {
+		// Progress must only be reported for data actually read.
+		buf := make([]byte, 1024)
+		var read int64
+		for {
+			n, err := r.Body.Read(buf)
+			read += int64(n)
+			mu.Lock()
+			if len(sent) > 0 {
+				assert(t, "sent <= read", sent[len(sent)-1] <= read)
+			}
+			mu.Unlock()
+			if err != nil {
+				break
+			}
+		}
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(ticketXML))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	ticket, err := c.UploadWithProgress("kitten.jpg", &zeroReader{n: size}, size,
+		map[string]string{}, progress)
+	assertOK(t, "UploadWithProgress", err)
+	assertEq(t, "ticket", "363", ticket)
+	assert(t, "calls", len(sent) > 2)
+	assertEq(t, "first", int64(0), sent[0])
+	assertEq(t, "last", size, sent[len(sent)-1])
+	for i := 1; i < len(sent); i++ {
+		assert(t, "increasing", sent[i] > sent[i-1])
+	}
+}
+
+func TestUploadSync(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8"?>
+    <rsp stat="ok">
+      <photoid>1234</photoid>
+    </rsp>`
+	postFn := func(r *http.Request) (*http.Response, error) {
+		assertOK(t, "parseForm", r.ParseMultipartForm(1024))
+		assertEq(t, "async", "0", r.MultipartForm.Value["async"][0])
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	photoID, err := c.UploadSync("kitten.jpg", strings.NewReader(jpegPhoto), int64(len(jpegPhoto)),
+		map[string]string{"async": "1"}, nil)
+	assertOK(t, "UploadSync", err)
+	assertEq(t, "photoID", "1234", photoID)
+}
+
+func TestUploadSyncFails(t *testing.T) {
+	xmlStr := `<rsp stat="fail"><err code="4" msg="Filesize was zero"/></rsp>`
+	postFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	photoID, err := c.UploadSync("kitten.jpg", strings.NewReader(""), 0,
+		map[string]string{}, nil)
+	assertEq(t, "photoID", "", photoID)
+	var fErr *Error
+	assert(t, "errors.As", errors.As(err, &fErr))
+	assertEq(t, "code", 4, fErr.Code)
+}
+
+func TestUploadOptionsArgs(t *testing.T) {
+	opts := &UploadOptions{
+		Title:       "kitten",
+		Description: "my cute kitten",
+		Tags:        []string{"cat", "new york"},
+		IsPublic:    Bool(false),
+		IsFamily:    Bool(true),
+		SafetyLevel: SafetyModerate,
+		ContentType: ContentScreenshot,
+		Hidden:      Bool(true),
+	}
+	args := opts.Args()
+	assertEq(t, "len(args)", 9, len(args))
+	assertEq(t, "title", "kitten", args["title"])
+	assertEq(t, "description", "my cute kitten", args["description"])
+	assertEq(t, "tags", `cat "new york"`, args["tags"])
+	assertEq(t, "is_public", "0", args["is_public"])
+	assertEq(t, "is_family", "1", args["is_family"])
+	assertEq(t, "safety_level", "2", args["safety_level"])
+	assertEq(t, "content_type", "2", args["content_type"])
+	assertEq(t, "hidden", "2", args["hidden"])
+	assertEq(t, "async", "1", args["async"])
+
+	args = (&UploadOptions{Sync: true}).Args()
+	assertEq(t, "len(args) sync", 1, len(args))
+	assertEq(t, "sync", "0", args["async"])
+}
+
+func TestUploadWithOptions(t *testing.T) {
+	postFn := func(r *http.Request) (*http.Response, error) {
+		assertOK(t, "parseForm", r.ParseMultipartForm(1024))
+		v := r.MultipartForm.Value
+		assertEq(t, "title", "kitten", v["title"][0])
+		assertEq(t, "is_friend", "1", v["is_friend"][0])
+		assertEq(t, "async", "1", v["async"][0])
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(ticketXML))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	called := false
+	opts := &UploadOptions{
+		Title:    "kitten",
+		IsFriend: Bool(true),
+		Progress: func(sent, total int64) { called = true },
+	}
+	r, err := c.UploadWithOptions("kitten.jpg", strings.NewReader(jpegPhoto), int64(len(jpegPhoto)), opts)
+	assertOK(t, "UploadWithOptions", err)
+	assertEq(t, "ticket", "363", r.TicketID)
+	assertEq(t, "photo", "", r.PhotoID)
+	assert(t, "progress", called)
+}
+
+func TestReplace(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8"?>
+    <rsp stat="ok">
+      <photoid secret="abcdef" originalsecret="abcdef">1234</photoid>
+    </rsp>`
+	postFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "url", "https://up.flickr.com/services/replace/", r.URL.String())
+		assertOK(t, "parseForm", r.ParseMultipartForm(1024))
+		v := r.MultipartForm.Value
+		assertEq(t, "photo_id", "1234", v["photo_id"][0])
+		assertEq(t, "async", "0", v["async"][0])
+		assertEq(t, "api_sig", 1, len(v["api_sig"]))
+		f, _ := r.MultipartForm.File["photo"][0].Open()
+		data, _ := ioutil.ReadAll(f)
+		assertEq(t, "photo", jpegHead+"new photo", string(data))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	r, err := c.Replace("1234", "kitten.jpg", &onceReader{jpegHead + "new photo"}, -1, false, nil)
+	assertOK(t, "Replace", err)
+	assertEq(t, "photoID", "1234", r.PhotoID)
+	assertEq(t, "ticketID", "", r.TicketID)
+}
+
+func TestReplaceAsyncFails(t *testing.T) {
+	xmlStr := `<rsp stat="fail"><err code="1" msg="Photo not found"/></rsp>`
+	postFn := func(r *http.Request) (*http.Response, error) {
+		assertOK(t, "parseForm", r.ParseMultipartForm(1024))
+		assertEq(t, "async", "1", r.MultipartForm.Value["async"][0])
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	r, err := c.Replace("1234", "kitten.jpg", strings.NewReader(jpegPhoto), int64(len(jpegPhoto)), true, nil)
+	assert(t, "result", r == nil)
+	var fErr *Error
+	assert(t, "errors.As", errors.As(err, &fErr))
+	assertEq(t, "method", "replace", fErr.Method)
+}
+
+// Non-seekable reader of a string.
+type onceReader struct {
+	s string
+}
+
+func (r *onceReader) Read(p []byte) (int, error) {
+	if r.s == "" {
+		return 0, io.EOF
+	}
+	n := copy(p, r.s)
+	r.s = r.s[n:]
+	return n, nil
+}
+
+func TestReplaceRequestOAuth(t *testing.T) {
+	defer fixOAuthParams()()
+	c := newClient(nil)
+	c.OAuthToken = "oauth-token"
+	c.OAuthTokenSecret = "oauth-secret"
+	req, rqErr := multipartRequest(c, replaceURL, "kitten.jpg", strings.NewReader(jpegPhoto),
+		int64(len(jpegPhoto)),
+		map[string]string{"photo_id": "1234"}, nil)
+	assertOK(t, "multipartRequest", rqErr)
+	assertOK(t, "parseForm", req.ParseMultipartForm(128))
+	signed := make(map[string]string)
+	for k, v := range req.MultipartForm.Value {
+		signed[k] = v[0]
+	}
+	sig := signed["oauth_signature"]
+	delete(signed, "oauth_signature")
+	assertEq(t, "signature", oauthSign("POST", replaceURL, signed, secret, "oauth-secret"), sig)
+}
+
+func TestCreateSet(t *testing.T) {
+	postFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "http method", "POST", r.Method)
+		assertOK(t, "ParseForm", r.ParseForm())
+		assertEq(t, "method", "flickr.photosets.create", r.PostForm.Get("method"))
+		assertEq(t, "title", "Flowers", r.PostForm.Get("title"))
+		assertEq(t, "primary_photo_id", "2345", r.PostForm.Get("primary_photo_id"))
+		xmlStr := `<rsp stat="ok"><photoset id="1234" url="http://www.flickr.com/photos/bees/sets/1234/"/></rsp>`
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	set, err := c.CreateSet("Flowers", "", "2345")
+	assertOK(t, "CreateSet", err)
+	assertEq(t, "id", "1234", set.ID)
+	assertEq(t, "title", "Flowers", set.Title)
+}
+
+func TestCreateSetNotRetried(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	n := 0
+	c := newClient(newSequenceClient(&n,
+		[]int{503, 200}, []string{"unavailable", `<rsp stat="ok"><photoset id="1"/></rsp>`}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	_, err := c.CreateSet("Flowers", "", "2345")
+	var hErr *HTTPError
+	assert(t, "http error", errors.As(err, &hErr))
+	assertEq(t, "requests", 1, n)
+}
+
+func TestSetWriteMethods(t *testing.T) {
+	var form url.Values
+	c := newClient(newFormClient(t, &form))
+	tests := []struct {
+		call   func() error
+		method string
+		args   map[string]string
+	}{
+		{func() error { return c.AddPhotoToSet("2", "1") }, "flickr.photosets.addPhoto",
+			map[string]string{"photoset_id": "1", "photo_id": "2"}},
+		{func() error { return c.DeleteSet("1") }, "flickr.photosets.delete",
+			map[string]string{"photoset_id": "1"}},
+		{func() error { return c.EditSetMeta("1", "Flowers", "Spring") }, "flickr.photosets.editMeta",
+			map[string]string{"photoset_id": "1", "title": "Flowers", "description": "Spring"}},
+		{func() error { return c.EditSetPhotos("1", "3", []string{"2", "3"}) },
+			"flickr.photosets.editPhotos",
+			map[string]string{"photoset_id": "1", "primary_photo_id": "3", "photo_ids": "2,3"}},
+		{func() error { return c.RemovePhotoFromSet("2", "1") }, "flickr.photosets.removePhoto",
+			map[string]string{"photoset_id": "1", "photo_id": "2"}},
+		{func() error { return c.RemovePhotosFromSet("1", []string{"2", "3"}) },
+			"flickr.photosets.removePhotos",
+			map[string]string{"photoset_id": "1", "photo_ids": "2,3"}},
+		{func() error { return c.ReorderSetPhotos("1", []string{"3", "2"}) },
+			"flickr.photosets.reorderPhotos",
+			map[string]string{"photoset_id": "1", "photo_ids": "3,2"}},
+		{func() error { return c.SetPrimaryPhoto("1", "3") }, "flickr.photosets.setPrimaryPhoto",
+			map[string]string{"photoset_id": "1", "photo_id": "3"}},
+		{func() error { return c.OrderSets([]string{"5", "1"}) }, "flickr.photosets.orderSets",
+			map[string]string{"photoset_ids": "5,1"}},
+	}
+	for _, tt := range tests {
+		assertOK(t, tt.method, tt.call())
+		assertEq(t, "method", tt.method, form.Get("method"))
+		for k, v := range tt.args {
+			assertEq(t, tt.method+" "+k, v, form.Get(k))
+		}
+	}
+}
+
+func TestGetSetInfo(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photoset id="72157624618609504" owner="34427466731@N01" username="bees"
+          primary="4847770787" secret="6abd09a292" server="4153" farm="5"
+          photos="55" videos="2" count_views="40" count_comments="1"
+          can_comment="1" date_create="1280530593" date_update="1308091378">
+        <title>Mah Kittehs</title>
+        <description>Sixty and Niner</description>
+      </photoset>
+    </rsp>`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "method", "flickr.photosets.getInfo", r.URL.Query().Get("method"))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	set, err := c.GetSetInfo("72157624618609504")
+	assertOK(t, "GetSetInfo", err)
+	assertEq(t, "owner", "34427466731@N01", set.Owner)
+	assertEq(t, "owner name", "bees", set.OwnerName)
+	assertEq(t, "photos", "55", set.Photos)
+	assertEq(t, "videos", "2", set.Videos)
+	assertEq(t, "date_update", "1308091378", set.DateUpdate)
+	assertEq(t, "title", "Mah Kittehs", set.Title)
+	assertEq(t, "primary URL",
+		"http://farm5.static.flickr.com/4153/4847770787_6abd09a292_s.jpg", set.PrimaryURL("s"))
+}
+
+func TestGetSetPhotos(t *testing.T) {
+	jsonStr := `jsonFlickrApi({"photoset": {"id": "4", "primary": "2483", "owner": "W@N01",
+        "ownername": "bees", "page": 2, "per_page": 1, "perpage": 1, "pages": 2,
+        "total": "2", "title": "Test", "photo": [
+          {"id": "2484", "secret": "123456", "server": "1", "farm": 1,
+           "title": "my photo", "isprimary": "0", "datetaken": "2011-01-01 10:00:00"}
+        ]}, "stat": "ok"})`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		q := r.URL.Query()
+		assertEq(t, "method", "flickr.photosets.getPhotos", q.Get("method"))
+		assertEq(t, "page", "2", q.Get("page"))
+		assertEq(t, "per_page", "1", q.Get("per_page"))
+		assertEq(t, "extras", "date_taken,url_m", q.Get("extras"))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(jsonStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.Format = FormatJSON
+	r, err := c.GetSetPhotos("4", 2, 1, []string{"date_taken", "url_m"})
+	assertOK(t, "GetSetPhotos", err)
+	assertEq(t, "page", "2", r.Page)
+	assertEq(t, "pages", "2", r.Pages)
+	assertEq(t, "total", "2", r.Total)
+	assertEq(t, "owner name", "bees", r.OwnerName)
+	assertEq(t, "len(photos)", 1, len(r.Photos))
+	assertEq(t, "photo id", "2484", r.Photos[0].ID)
+	assertEq(t, "farm", "1", r.Photos[0].Farm)
+	assertEq(t, "isprimary", "0", r.Photos[0].IsPrimary)
+}
+
+const photoInfoXML = `<rsp stat="ok">
+  <photo id="2733" secret="123456" server="12" farm="1" dateuploaded="1100897479"
+      isfavorite="0" license="3" safety_level="0" rotation="90"
+      originalsecret="1bc09ce34a" originalformat="png" views="4" media="photo">
+    <owner nsid="12037949754@N01" username="Bees" realname="Cal Henderson"
+        location="Bedford, UK" iconserver="1" iconfarm="1" path_alias="bees"/>
+    <title>orford_castle_taster</title>
+    <description>hello!</description>
+    <visibility ispublic="1" isfriend="0" isfamily="0"/>
+    <dates posted="1100897479" taken="2004-11-19 12:51:19" takengranularity="0"
+        takenunknown="0" lastupdate="1093022469"/>
+    <permissions permcomment="3" permaddmeta="2"/>
+    <editability cancomment="1" canaddmeta="1"/>
+    <publiceditability cancomment="1" canaddmeta="0"/>
+    <comments>1</comments>
+    <notes>
+      <note id="313" author="12037949754@N01" authorname="Bees" x="10" y="10"
+          w="50" h="50">foo</note>
+    </notes>
+    <tags>
+      <tag id="1234" author="12037949754@N01" raw="woo yay" machine_tag="0">wooyay</tag>
+      <tag id="1235" author="12037949754@N01" raw="geo:lat=52.09" machine_tag="1">geo:lat=52.09</tag>
+    </tags>
+    <location latitude="52.09" longitude="1.53" accuracy="16" place_id="abc" woeid="123">
+      <locality place_id="def" woeid="456">Orford</locality>
+      <country place_id="ghi" woeid="789">United Kingdom</country>
+    </location>
+    <urls>
+      <url type="photopage">http://www.flickr.com/photos/bees/2733/</url>
+    </urls>
+  </photo>
+</rsp>`
+
+const photoInfoJSON = `jsonFlickrApi({"photo": {"id": "2733", "secret": "123456",
+  "server": "12", "farm": 1, "dateuploaded": "1100897479", "isfavorite": 0,
+  "license": "3", "safety_level": "0", "rotation": 90,
+  "originalsecret": "1bc09ce34a", "originalformat": "png", "views": "4",
+  "media": "photo",
+  "owner": {"nsid": "12037949754@N01", "username": "Bees",
+    "realname": "Cal Henderson", "location": "Bedford, UK", "iconserver": "1",
+    "iconfarm": 1, "path_alias": "bees"},
+  "title": {"_content": "orford_castle_taster"},
+  "description": {"_content": "hello!"},
+  "visibility": {"ispublic": 1, "isfriend": 0, "isfamily": 0},
+  "dates": {"posted": "1100897479", "taken": "2004-11-19 12:51:19",
+    "takengranularity": 0, "takenunknown": "0", "lastupdate": "1093022469"},
+  "permissions": {"permcomment": 3, "permaddmeta": 2},
+  "editability": {"cancomment": 1, "canaddmeta": 1},
+  "publiceditability": {"cancomment": 1, "canaddmeta": 0},
+  "comments": {"_content": 1},
+  "notes": {"note": [{"id": "313", "author": "12037949754@N01",
+    "authorname": "Bees", "x": "10", "y": "10", "w": "50", "h": "50",
+    "_content": "foo"}]},
+  "tags": {"tag": [
+    {"id": "1234", "author": "12037949754@N01", "raw": "woo yay",
+     "_content": "wooyay", "machine_tag": 0},
+    {"id": "1235", "author": "12037949754@N01", "raw": "geo:lat=52.09",
+     "_content": "geo:lat=52.09", "machine_tag": 1}]},
+  "location": {"latitude": 52.09, "longitude": 1.53, "accuracy": 16,
+    "place_id": "abc", "woeid": "123",
+    "locality": {"_content": "Orford", "place_id": "def", "woeid": "456"},
+    "country": {"_content": "United Kingdom", "place_id": "ghi", "woeid": "789"}},
+  "urls": {"url": [{"type": "photopage",
+    "_content": "http://www.flickr.com/photos/bees/2733/"}]}
+}, "stat": "ok"})`
+
+func verifyPhotoInfo(t *testing.T, p *PhotoInfo) {
+	assertEq(t, "id", "2733", p.ID)
+	assertEq(t, "farm", "1", p.Farm)
+	assertEq(t, "rotation", "90", p.Rotation)
+	assertEq(t, "media", "photo", p.Media)
+	assertEq(t, "owner", "Cal Henderson", p.Owner.RealName)
+	assertEq(t, "title", "orford_castle_taster", p.Title)
+	assertEq(t, "description", "hello!", p.Description)
+	assertEq(t, "ispublic", "1", p.Visibility.IsPublic)
+	assertEq(t, "granularity", GranularitySecond, p.Dates.TakenGranularity)
+	taken, tErr := p.Dates.TakenTime()
+	assertOK(t, "TakenTime", tErr)
+	assertEq(t, "taken", time.Date(2004, 11, 19, 12, 51, 19, 0, time.UTC), taken)
+	posted, pErr := p.Dates.PostedTime()
+	assertOK(t, "PostedTime", pErr)
+	assertEq(t, "posted", int64(1100897479), posted.Unix())
+	assertEq(t, "permcomment", "3", p.Permissions.PermComment)
+	assertEq(t, "canaddmeta", "1", p.Editability.CanAddMeta)
+	assertEq(t, "public canaddmeta", "0", p.PublicEditability.CanAddMeta)
+	assertEq(t, "comments", "1", p.Comments)
+	assertEq(t, "len(notes)", 1, len(p.Notes))
+	assertEq(t, "note", "foo", p.Notes[0].Text)
+	assertEq(t, "note w", "50", p.Notes[0].W)
+	assertEq(t, "len(tags)", 2, len(p.Tags))
+	assertEq(t, "tag", "wooyay", p.Tags[0].Text)
+	assertEq(t, "raw tag", "woo yay", p.Tags[0].Raw)
+	assert(t, "not machine tag", !p.Tags[0].IsMachineTag())
+	assert(t, "machine tag", p.Tags[1].IsMachineTag())
+	assert(t, "location", p.Location != nil)
+	assertEq(t, "latitude", "52.09", p.Location.Latitude)
+	assertEq(t, "locality", "Orford", p.Location.Locality.Name)
+	assertEq(t, "country woeid", "789", p.Location.Country.WOEID)
+	assertEq(t, "len(urls)", 1, len(p.URLs))
+	assertEq(t, "url", "http://www.flickr.com/photos/bees/2733/", p.URLs[0].URL)
+	assertEq(t, "original",
+		"http://farm1.static.flickr.com/12/2733_1bc09ce34a_o.png", p.OriginalURL())
+}
+
+func TestGetPhotoInfo(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "method", "flickr.photos.getInfo", r.URL.Query().Get("method"))
+		assertEq(t, "photo_id", "2733", r.URL.Query().Get("photo_id"))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(photoInfoXML))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	p, err := c.GetPhotoInfo("2733")
+	assertOK(t, "GetPhotoInfo", err)
+	verifyPhotoInfo(t, p)
+}
+
+func TestGetPhotoInfoJSON(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(photoInfoJSON))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.Format = FormatJSON
+	p, err := c.GetPhotoInfo("2733")
+	assertOK(t, "GetPhotoInfo", err)
+	verifyPhotoInfo(t, p)
+
+	// PhotoInfo survives a round trip through JSON.
+	data, mErr := json.Marshal(p)
+	assertOK(t, "Marshal", mErr)
+	var decoded PhotoInfo
+	assertOK(t, "Unmarshal", json.Unmarshal(data, &decoded))
+	verifyPhotoInfo(t, &decoded)
+}
+
+const sizesXML = `<rsp stat="ok">
+  <sizes canblog="1" canprint="1" candownload="1">
+    <size label="Square" width="75" height="75" media="photo"
+        source="https://farm2.staticflickr.com/1103/567229075_2cf8456f01_s.jpg"
+        url="https://www.flickr.com/photos/stewart/567229075/sizes/sq/"/>
+    <size label="Small" width="240" height="180" media="photo"
+        source="https://farm2.staticflickr.com/1103/567229075_2cf8456f01_m.jpg"
+        url="https://www.flickr.com/photos/stewart/567229075/sizes/s/"/>
+    <size label="Medium" width="500" height="375" media="photo"
+        source="https://farm2.staticflickr.com/1103/567229075_2cf8456f01.jpg"
+        url="https://www.flickr.com/photos/stewart/567229075/sizes/m/"/>
+    <size label="Original" width="2400" height="1800" media="photo"
+        source="https://farm2.staticflickr.com/1103/567229075_6dc09dc6da_o.jpg"
+        url="https://www.flickr.com/photos/stewart/567229075/sizes/o/"/>
+    <size label="Site MP4" width="640" height="480" media="video"
+        source="https://www.flickr.com/photos/stewart/567229075/play/site/2cf8456f01/"
+        url="https://www.flickr.com/photos/stewart/567229075/"/>
+  </sizes>
+</rsp>`
+
+func TestGetSizes(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "method", "flickr.photos.getSizes", r.URL.Query().Get("method"))
+		assertEq(t, "photo_id", "567229075", r.URL.Query().Get("photo_id"))
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(sizesXML))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	sizes, err := c.GetSizes("567229075")
+	assertOK(t, "GetSizes", err)
+	assertEq(t, "len(sizes)", 5, len(sizes))
+	assertEq(t, "label", "Original", sizes[3].Label)
+	assertEq(t, "width", "2400", sizes[3].Width)
+	assertEq(t, "source", "https://farm2.staticflickr.com/1103/567229075_6dc09dc6da_o.jpg",
+		sizes[3].Source)
+	assertEq(t, "media", "video", sizes[4].Media)
+
+	p := Photo{ID: "567229075"}
+	s, bErr := p.BestSize(c, 800, 600)
+	assertOK(t, "BestSize", bErr)
+	assertEq(t, "best", "Medium", s.Label)
+}
+
+func TestBestSize(t *testing.T) {
+	sizes := []Size{
+		{Label: "Square", Width: "75", Height: "75"},
+		{Label: "Small", Width: "240", Height: "180"},
+		{Label: "Medium", Width: "500", Height: "375"},
+		{Label: "Original", Width: "2400", Height: "1800"},
+		{Label: "Video", Width: "3000", Height: "2000", Media: "video"},
+	}
+	assertEq(t, "box", "Small", BestSize(sizes, 400, 200).Label)
+	assertEq(t, "width only", "Medium", BestSize(sizes, 500, 0).Label)
+	assertEq(t, "unlimited", "Original", BestSize(sizes, 0, 0).Label)
+	assertEq(t, "too small", "Square", BestSize(sizes, 10, 10).Label)
+	assert(t, "no sizes", BestSize(nil, 10, 10) == nil)
+}
+
+func TestGetExif(t *testing.T) {
+	xmlStr := `<rsp stat="ok">
+      <photo id="4424" secret="06b8e43bc7" server="2" farm="1" camera="Canon EOS 400D">
+        <exif tagspace="IFD0" tagspaceid="0" tag="Make" label="Make">
+          <raw>Canon</raw>
+        </exif>
+        <exif tagspace="ExifIFD" tagspaceid="0" tag="ExposureTime" label="Exposure">
+          <raw>1/60</raw>
+          <clean>0.017 sec (1/60)</clean>
+        </exif>
+      </photo>
+    </rsp>`
+	jsonStr := `jsonFlickrApi({"photo": {"id": "4424", "secret": "06b8e43bc7",
+      "server": "2", "farm": 1, "camera": "Canon EOS 400D", "exif": [
+        {"tagspace": "IFD0", "tagspaceid": 0, "tag": "Make", "label": "Make",
+         "raw": {"_content": "Canon"}},
+        {"tagspace": "ExifIFD", "tagspaceid": 0, "tag": "ExposureTime",
+         "label": "Exposure", "raw": {"_content": "1/60"},
+         "clean": {"_content": "0.017 sec (1/60)"}}]}, "stat": "ok"})`
+	for _, format := range []string{FormatXML, FormatJSON} {
+		getFn := func(r *http.Request) (*http.Response, error) {
+			assertEq(t, "method", "flickr.photos.getExif", r.URL.Query().Get("method"))
+			body := xmlStr
+			if format == FormatJSON {
+				body = jsonStr
+			}
+			return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+		}
+		c := newClient(newHTTPClient(getFn))
+		c.Format = format
+		e, err := c.GetExif("4424")
+		assertOK(t, format+" GetExif", err)
+		assertEq(t, format+" camera", "Canon EOS 400D", e.Camera)
+		assertEq(t, format+" len(tags)", 2, len(e.Tags))
+		assertEq(t, format+" tagspace", "ExifIFD", e.Tags[1].TagSpace)
+		assertEq(t, format+" label", "Exposure", e.Tags[1].Label)
+		assertEq(t, format+" raw", "1/60", e.Tags[1].Raw)
+		assertEq(t, format+" clean", "0.017 sec (1/60)", e.Tags[1].Clean)
+		assertEq(t, format+" make", "Canon", e.Make())
+	}
+}
+
+func TestPhotoWriteMethods(t *testing.T) {
+	var form url.Values
+	c := newClient(newFormClient(t, &form))
+	taken := time.Date(2004, 11, 19, 12, 51, 19, 0, time.UTC)
+	tests := []struct {
+		call   func() error
+		method string
+		args   map[string]string
+	}{
+		{func() error { return c.SetMeta("1", "Kitten", "My cute kitten") }, "flickr.photos.setMeta",
+			map[string]string{"photo_id": "1", "title": "Kitten", "description": "My cute kitten"}},
+		{func() error { return c.SetDates("1", time.Unix(1100897479, 0), taken, GranularityMonth) },
+			"flickr.photos.setDates",
+			map[string]string{"photo_id": "1", "date_posted": "1100897479",
+				"date_taken": "2004-11-19 12:51:19", "date_taken_granularity": "4"}},
+		{func() error { return c.SetContentType("1", ContentScreenshot) },
+			"flickr.photos.setContentType",
+			map[string]string{"photo_id": "1", "content_type": "2"}},
+		{func() error { return c.SetSafetyLevel("1", SafetyRestricted, Bool(true)) },
+			"flickr.photos.setSafetyLevel",
+			map[string]string{"photo_id": "1", "safety_level": "3", "hidden": "1"}},
+		{func() error { return c.SetLicense("1", LicenseCCBy) },
+			"flickr.photos.licenses.setLicense",
+			map[string]string{"photo_id": "1", "license_id": "4"}},
+		{func() error { return c.SetLicense("1", LicenseAllRightsReserved) },
+			"flickr.photos.licenses.setLicense",
+			map[string]string{"photo_id": "1", "license_id": "0"}},
+	}
+	for _, tt := range tests {
+		assertOK(t, tt.method, tt.call())
+		assertEq(t, "method", tt.method, form.Get("method"))
+		for k, v := range tt.args {
+			assertEq(t, tt.method+" "+k, v, form.Get(k))
+		}
+	}
+
+	assertOK(t, "SetDates", c.SetDates("1", time.Time{}, taken, ""))
+	_, ok := form["date_posted"]
+	assert(t, "date_posted omitted", !ok)
+	assertOK(t, "SetSafetyLevel", c.SetSafetyLevel("1", 0, Bool(false)))
+	_, ok = form["safety_level"]
+	assert(t, "safety_level omitted", !ok)
+	assertEq(t, "hidden", "0", form.Get("hidden"))
+}
+
+func TestTagMethods(t *testing.T) {
+	var form url.Values
+	c := newClient(newFormClient(t, &form))
+	tags := []string{"kitten", "new york", "dc:title=My cat"}
+
+	assertOK(t, "AddTags", c.AddTags("1", tags))
+	assertEq(t, "method", "flickr.photos.addTags", form.Get("method"))
+	assertEq(t, "photo_id", "1", form.Get("photo_id"))
+	assertEq(t, "tags", `kitten "new york" "dc:title=My cat"`, form.Get("tags"))
+
+	assertOK(t, "SetTags", c.SetTags("1", tags[:2]))
+	assertEq(t, "method", "flickr.photos.setTags", form.Get("method"))
+	assertEq(t, "tags", `kitten "new york"`, form.Get("tags"))
+
+	assertOK(t, "RemoveTag", c.RemoveTag("1234-2733-5678"))
+	assertEq(t, "method", "flickr.photos.removeTag", form.Get("method"))
+	assertEq(t, "tag_id", "1234-2733-5678", form.Get("tag_id"))
+}
+
+func TestApplyTags(t *testing.T) {
+	var calls []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		body := `<rsp stat="ok"/>`
+		if r.Method == "GET" {
+			assertEq(t, "method", "flickr.photos.getInfo", r.URL.Query().Get("method"))
+			body = photoInfoXML
+		} else {
+			r.ParseForm()
+			calls = append(calls, r.PostForm.Get("method")+" "+r.PostForm.Get("tag_id")+
+				r.PostForm.Get("tags"))
+		}
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+
+	// The photo has "woo yay" and "geo:lat=52.09".
+	added, removed, err := c.ApplyTags("2733", []string{"Woo Yay", "new york", "new york"})
+	assertOK(t, "ApplyTags", err)
+	assertEq(t, "added", "new york", strings.Join(added, ","))
+	assertEq(t, "removed", "1235", strings.Join(removed, ","))
+	assertEq(t, "calls", `flickr.photos.removeTag 1235,flickr.photos.addTags "new york"`,
+		strings.Join(calls, ","))
+
+	calls = nil
+	added, removed, err = c.ApplyTags("2733", []string{"woo yay", "GEO:LAT=52.09"})
+	assertOK(t, "ApplyTags unchanged", err)
+	assertEq(t, "nothing added", 0, len(added))
+	assertEq(t, "nothing removed", 0, len(removed))
+	assertEq(t, "no calls", 0, len(calls))
+}
+
+//-----------------------
+// Tests for oauth.go
+//
+
+// Replaces the OAuth nonce and timestamp sources with fixed values until the
+// returned function is called.
+func fixOAuthParams() func() {
+	origNow, origNonce := now, nonce
+	now = func() time.Time { return time.Unix(1305586162, 0) }
+	nonce = func() string { return "89601180" }
+	return func() {
+		now, nonce = origNow, origNonce
+	}
+}
+
+func TestOAuthSign(t *testing.T) {
+	args := map[string]string{
+		"oauth_callback":         "http://www.example.com",
+		"oauth_consumer_key":     "653e7a6ecc1d528c516cc8f92cf98611",
+		"oauth_nonce":            "95613465",
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        "1305586162",
+		"oauth_version":          "1.0",
+	}
+	base := "GET&https%3A%2F%2Fwww.flickr.com%2Fservices%2Foauth%2Frequest_token&" +
+		"oauth_callback%3Dhttp%253A%252F%252Fwww.example.com%26" +
+		"oauth_consumer_key%3D653e7a6ecc1d528c516cc8f92cf98611%26" +
+		"oauth_nonce%3D95613465%26" +
+		"oauth_signature_method%3DHMAC-SHA1%26" +
+		"oauth_timestamp%3D1305586162%26" +
+		"oauth_version%3D1.0"
+	m := hmac.New(sha1.New, []byte(secret+"&tok%20secret"))
+	write(m, base)
+	expected := base64.StdEncoding.EncodeToString(m.Sum(nil))
+
+	actual := oauthSign("GET", requestTokenURL, args, secret, "tok secret")
+	assertEq(t, "signature", expected, actual)
+}
+
+func TestOAuthEscape(t *testing.T) {
+	assertEq(t, "space", "a%20b", oauthEscape("a b"))
+	assertEq(t, "unreserved", "a-b_c.d~e", oauthEscape("a-b_c.d~e"))
+	assertEq(t, "reserved", "%2A%2B%26%3D", oauthEscape("*+&="))
+}
+
+func TestMakeURLOAuth(t *testing.T) {
+	defer fixOAuthParams()()
+	c := newClient(nil)
+	c.AuthToken = "legacy"
+	c.OAuthToken = "oauth-token"
+	c.OAuthTokenSecret = "oauth-secret"
+
+	u, uErr := url.Parse(makeURL(c, "flickr.test.login", map[string]string{"a": "b c"}, true))
+	assertOK(t, "parseURL", uErr)
+	a := u.Query()
+	assertEq(t, "method", "flickr.test.login", a.Get("method"))
+	assertEq(t, "a", "b c", a.Get("a"))
+	assertEq(t, "consumer_key", apiKey, a.Get("oauth_consumer_key"))
+	assertEq(t, "token", "oauth-token", a.Get("oauth_token"))
+	assertEq(t, "nonce", "89601180", a.Get("oauth_nonce"))
+	assertEq(t, "timestamp", "1305586162", a.Get("oauth_timestamp"))
+	assertEq(t, "auth_token", 0, len(a["auth_token"]))
+	assertEq(t, "api_sig", 0, len(a["api_sig"]))
+
+	signed := make(map[string]string)
+	for k, v := range a {
+		signed[k] = v[0]
+	}
+	delete(signed, "oauth_signature")
+	assertEq(t, "signature",
+		oauthSign("GET", "https://api.flickr.com/services/rest/", signed, secret, "oauth-secret"),
+		a.Get("oauth_signature"))
+
+	u, uErr = url.Parse(makeURL(c, "flickr.test.echo", map[string]string{}, false))
+	assertOK(t, "parseURL", uErr)
+	assertEq(t, "unauthenticated token", 0, len(u.Query()["oauth_token"]))
+	assertEq(t, "unauthenticated signature", 1, len(u.Query()["oauth_signature"]))
+}
+
+func TestGetRequestToken(t *testing.T) {
+	defer fixOAuthParams()()
+	getFn := func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "host", "www.flickr.com", r.URL.Host)
+		assertEq(t, "path", "/services/oauth/request_token", r.URL.Path)
+		assertEq(t, "callback", "http://example.com/cb", r.URL.Query().Get("oauth_callback"))
+		assertEq(t, "token", 0, len(r.URL.Query()["oauth_token"]))
+		body := "oauth_callback_confirmed=true&oauth_token=72157626737672178-022bbd2f4c2f3432" +
+			"&oauth_token_secret=fccb68c4e6103197"
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	rt, err := c.GetRequestToken("http://example.com/cb")
+	assertOK(t, "GetRequestToken", err)
+	assertEq(t, "token", "72157626737672178-022bbd2f4c2f3432", rt.Token)
+	assertEq(t, "secret", "fccb68c4e6103197", rt.Secret)
+}
+
+func TestGetRequestTokenProblem(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		body := "oauth_problem=signature_invalid"
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	_, err := c.GetRequestToken(OutOfBandCallback)
+	assert(t, "err", err != nil)
+	assert(t, "message: "+err.Error(), strings.Contains(err.Error(), "signature_invalid"))
+}
+
+func TestAuthorizeURL(t *testing.T) {
+	c := newClient(nil)
+	u, uErr := url.Parse(c.AuthorizeURL("72157626737672178-022bbd2f4c2f3432", WritePerm))
+	assertOK(t, "parseURL", uErr)
+	assertEq(t, "host", "www.flickr.com", u.Host)
+	assertEq(t, "path", "/services/oauth/authorize", u.Path)
+	assertEq(t, "token", "72157626737672178-022bbd2f4c2f3432", u.Query().Get("oauth_token"))
+	assertEq(t, "perms", WritePerm, u.Query().Get("perms"))
+}
+
+func TestGetAccessToken(t *testing.T) {
+	defer fixOAuthParams()()
+	rt := &RequestToken{Token: "req-token", Secret: "req-secret"}
+	getFn := func(r *http.Request) (*http.Response, error) {
+		a := r.URL.Query()
+		assertEq(t, "path", "/services/oauth/access_token", r.URL.Path)
+		assertEq(t, "verifier", "5d1b96a26b494074", a.Get("oauth_verifier"))
+		assertEq(t, "token", "req-token", a.Get("oauth_token"))
+		signed := make(map[string]string)
+		for k, v := range a {
+			signed[k] = v[0]
+		}
+		delete(signed, "oauth_signature")
+		assertEq(t, "signature",
+			oauthSign("GET", accessTokenURL, signed, secret, "req-secret"),
+			a.Get("oauth_signature"))
+		body := "fullname=Jamal%20Fanaian&oauth_token=72157626318069415-087bfc7b5816092c" +
+			"&oauth_token_secret=a202d1f853ec69de&user_nsid=21207597%40N07&username=jamalfanaian"
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	at, err := c.GetAccessToken(rt, "5d1b96a26b494074")
+	assertOK(t, "GetAccessToken", err)
+	assertEq(t, "token", "72157626318069415-087bfc7b5816092c", at.Token)
+	assertEq(t, "secret", "a202d1f853ec69de", at.Secret)
+	assertEq(t, "nsid", "21207597@N07", at.User.NSID)
+	assertEq(t, "username", "jamalfanaian", at.User.UserName)
+	assertEq(t, "fullname", "Jamal Fanaian", at.User.FullName)
+}
+
+func TestUploadRequestOAuth(t *testing.T) {
+	defer fixOAuthParams()()
+	c := newClient(nil)
+	c.OAuthToken = "oauth-token"
+	c.OAuthTokenSecret = "oauth-secret"
+	req, rqErr := multipartRequest(c, uploadURL, "kitten.jpg", strings.NewReader(jpegPhoto),
+		int64(len(jpegPhoto)),
+		map[string]string{"title": "kitten"}, nil)
+	assertOK(t, "multipartRequest", rqErr)
+	assertOK(t, "parseForm", req.ParseMultipartForm(128))
+
+	signed := make(map[string]string)
+	for k, v := range req.MultipartForm.Value {
+		signed[k] = v[0]
+	}
+	sig := signed["oauth_signature"]
+	delete(signed, "oauth_signature")
+	assertEq(t, "api_sig", "", signed["api_sig"])
+	assertEq(t, "title", "kitten", signed["title"])
+	assertEq(t, "async", "1", signed["async"])
+	assertEq(t, "token", "oauth-token", signed["oauth_token"])
+	assertEq(t, "signature", oauthSign("POST", uploadURL, signed, secret, "oauth-secret"), sig)
+}
+
+func TestMigrateTokenURL(t *testing.T) {
+	c := newClient(nil)
+	c.AuthToken = "other-token"
+	c.OAuthToken = "oauth-token"
+
+	u, uErr := url.Parse(migrateTokenURL(c, "ase878723623"))
+	assertOK(t, "parseURL", uErr)
+	a := u.Query()
+	assertEq(t, "method", "flickr.auth.oauth.getAccessToken", a.Get("method"))
+	assertEq(t, "auth_token", "ase878723623", a.Get("auth_token"))
+	assertEq(t, "api_key", apiKey, a.Get("api_key"))
+	assertEq(t, "api_sig", 1, len(a["api_sig"]))
+	assertEq(t, "oauth_signature", 0, len(a["oauth_signature"]))
+}
+
+func TestMigrateTokens(t *testing.T) {
+	getFn := func(r *http.Request) (*http.Response, error) {
+		var xmlStr string
+		if r.URL.Query().Get("auth_token") == "good" {
+			xmlStr = `<?xml version="1.0" encoding="utf-8" ?>
+        <rsp stat="ok">
+          <auth>
+            <access_token oauth_token="72157607082540144-8d5d7ea7696629bf"
+                oauth_token_secret="f38bf58b2d95bc8b" />
+          </auth>
+        </rsp>`
+		} else {
+			xmlStr = `<?xml version="1.0" encoding="utf-8" ?>
+        <rsp stat="fail">
+          <err code="98" msg="Invalid auth token"/>
+        </rsp>`
+		}
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	results := c.MigrateTokens([]string{"good", "bad"})
+	assertEq(t, "len(results)", 2, len(results))
+
+	assertEq(t, "0.authToken", "good", results[0].AuthToken)
+	assertOK(t, "0.err", results[0].Err)
+	assertEq(t, "0.token", "72157607082540144-8d5d7ea7696629bf", results[0].AccessToken.Token)
+	assertEq(t, "0.secret", "f38bf58b2d95bc8b", results[0].AccessToken.Secret)
+
+	assertEq(t, "1.authToken", "bad", results[1].AuthToken)
+	assert(t, "1.token", results[1].AccessToken == nil)
+	assert(t, "1.err", results[1].Err != nil &&
+		strings.Contains(results[1].Err.Error(), "code 98: Invalid auth token"))
+}
+
+//-----------------------
+// Tests for errors.go
+//
+
+func TestErrorIs(t *testing.T) {
+	err := wrapErr("uploading failed", &Error{Code: 98, Message: "Login failed", Method: "upload"})
+	assert(t, "invalid token", errors.Is(err, ErrInvalidAuthToken))
+	assert(t, "unavailable", !errors.Is(err, ErrServiceUnavailable))
+
+	notFound := &Error{Code: 1, Message: "Photo not found", Method: "flickr.photos.getInfo"}
+	assert(t, "photo not found", errors.Is(notFound, ErrPhotoNotFound))
+	setNotFound := &Error{Code: 1, Message: "Photoset not found", Method: "flickr.photosets.getInfo"}
+	assert(t, "photoset not found", !errors.Is(setNotFound, ErrPhotoNotFound))
+	tooManyTags := &Error{Code: 1, Message: "Too many tags in ALL query", Method: "flickr.photos.search"}
+	assert(t, "search", !errors.Is(tooManyTags, ErrPhotoNotFound))
+	tagNotFound := &Error{Code: 1, Message: "Tag not found", Method: "flickr.photos.removeTag"}
+	assert(t, "tag not found", !errors.Is(tagNotFound, ErrPhotoNotFound))
+
+	target := &Error{Code: 1, Method: "flickr.photosets.getInfo"}
+	assert(t, "exact method", errors.Is(setNotFound, target))
+	assert(t, "other method", !errors.Is(notFound, target))
+}
+
+func TestGetTokenTypedError(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8"?>
+    <rsp stat="fail">
+      <err code="97" msg="Missing signature"/>
+    </rsp>`
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(xmlStr)),
+		}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	_, _, err := c.GetToken("878243")
+	var fErr *Error
+	assert(t, "errors.As", errors.As(err, &fErr))
+	assertEq(t, "code", 97, fErr.Code)
+	assertEq(t, "message", "Missing signature", fErr.Message)
+	assertEq(t, "method", "flickr.auth.getToken", fErr.Method)
+	assertEq(t, "status", http.StatusOK, fErr.HTTPStatus)
+	assert(t, "errors.Is", errors.Is(err, ErrMissingSignature))
+}
+
+func TestUploadTypedError(t *testing.T) {
+	xmlStr := `<?xml version="1.0" encoding="utf-8"?>
+    <rsp stat="fail">
+      <err code="105" msg="Service currently unavailable"/>
+    </rsp>`
+	postFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	}
+	c := newClient(newHTTPClient(postFn))
+	_, err := c.Upload("kitten.jpg", []byte(jpegHead+"photo content"), map[string]string{})
+	var fErr *Error
+	assert(t, "errors.As", errors.As(err, &fErr))
+	assertEq(t, "method", "upload", fErr.Method)
+	assert(t, "errors.Is", errors.Is(err, ErrServiceUnavailable))
+}
+
+func TestFlickrGetHTTPError(t *testing.T) {
+	html := "<html><body>" + strings.Repeat("Bad Gateway ", 100) + "</body></html>"
+	closed := false
+	getFn := func(r *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusBadGateway,
+			Status:     "502 Bad Gateway",
+			Body:       &closeRecorder{Reader: strings.NewReader(html), closed: &closed},
+		}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	_, err := c.GetSets("me")
+	assert(t, "err", err != nil)
+	var hErr *HTTPError
+	assert(t, "errors.As", errors.As(err, &hErr))
+	assertEq(t, "status code", http.StatusBadGateway, hErr.StatusCode)
+	assertEq(t, "status", "502 Bad Gateway", hErr.Status)
+	assertEq(t, "body", html[:maxErrorBody], hErr.Body)
+	assert(t, "closed", closed)
+	var fErr *Error
+	assert(t, "not API error", !errors.As(err, &fErr))
+	assert(t, "message: "+err.Error(), strings.Contains(err.Error(), "HTTP error 502 Bad Gateway"))
+}
+
+// Response body that records whether it has been closed.
+type closeRecorder struct {
+	io.Reader
+	closed *bool
+}
+
+func (r *closeRecorder) Close() error {
+	*r.closed = true
+	return nil
+}
+
+//-----------------------
+// Tests for retry.go
+//
+
+// Replaces sleep with a function that records the delays until the returned
+// function is called.
+func recordSleeps(delays *[]time.Duration) func() {
+	orig := sleep
+	sleep = func(ctx context.Context, d time.Duration) error {
+		*delays = append(*delays, d)
+		return ctx.Err()
+	}
+	return func() {
+		sleep = orig
+	}
+}
+
+// Returns an HTTP client that responds to successive requests with the given
+// status codes and bodies, repeating the last one as necessary.  n is set to
+// the number of requests made.
+func newSequenceClient(n *int, statuses []int, bodies []string) *http.Client {
+	return newHTTPClient(func(r *http.Request) (*http.Response, error) {
+		i := *n
+		if i >= len(bodies) {
+			i = len(bodies) - 1
+		}
+		*n++
+		if r.Body != nil {
+			ioutil.ReadAll(r.Body)
+		}
+		return &http.Response{
+			StatusCode: statuses[i],
+			Body:       ioutil.NopCloser(strings.NewReader(bodies[i])),
+		}, nil
+	})
+}
+
+const (
+	unavailableXML = `<rsp stat="fail"><err code="105" msg="Service currently unavailable"/></rsp>`
+	ticketXML      = `<rsp stat="ok"><ticketid>363</ticketid></rsp>`
+	setsXML        = `<rsp stat="ok"><photosets><photoset id="1"/></photosets></rsp>`
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Second,
+		Multiplier:     3,
+	}
+	assertEq(t, "0", time.Second, p.backoff(0))
+	assertEq(t, "1", 3*time.Second, p.backoff(1))
+	assertEq(t, "2", 5*time.Second, p.backoff(2))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.backoff(0)
+		assert(t, fmt.Sprintf("jitter %v", d), d >= time.Second/2 && d <= 3*time.Second/2)
+	}
+}
+
+func TestRetryGet(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	n := 0
+	c := newClient(newSequenceClient(&n,
+		[]int{200, 502, 200},
+		[]string{unavailableXML, "<html>Bad Gateway</html>", setsXML}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Second}
+	sets, err := c.GetSets("me")
+	assertOK(t, "GetSets", err)
+	assertEq(t, "len(sets)", 1, len(sets))
+	assertEq(t, "requests", 3, n)
+	assertEq(t, "len(delays)", 2, len(delays))
+	assertEq(t, "delay 0", time.Second, delays[0])
+	assertEq(t, "delay 1", 2*time.Second, delays[1])
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	n := 0
+	c := newClient(newSequenceClient(&n, []int{200}, []string{unavailableXML}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	_, err := c.GetSets("me")
+	assert(t, "err", errors.Is(err, ErrServiceUnavailable))
+	assertEq(t, "requests", 3, n)
+
+	n = 0
+	c.Retry = &RetryPolicy{MaxAttempts: 3, RetryableCodes: []int{106}}
+	_, err = c.GetSets("me")
+	assert(t, "not retryable", errors.Is(err, ErrServiceUnavailable))
+	assertEq(t, "requests without retry", 1, n)
+
+	n = 0
+	c.Retry = nil
+	_, err = c.GetSets("me")
+	assert(t, "no policy", errors.Is(err, ErrServiceUnavailable))
+	assertEq(t, "requests without policy", 1, n)
+}
+
+func TestRetryUpload(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	n := 0
+	c := newClient(newSequenceClient(&n,
+		[]int{200, 200}, []string{unavailableXML, ticketXML}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	ticket, err := c.Upload("kitten.jpg", []byte(jpegPhoto), map[string]string{})
+	assertOK(t, "upload", err)
+	assertEq(t, "ticket", "363", ticket)
+	assertEq(t, "requests", 2, n)
+
+	// HTTP errors may have happened after Flickr received the photo.
+	n = 0
+	c = newClient(newSequenceClient(&n,
+		[]int{503, 200}, []string{"unavailable", ticketXML}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	_, err = c.Upload("kitten.jpg", []byte(jpegPhoto), map[string]string{})
+	var hErr *HTTPError
+	assert(t, "http error", errors.As(err, &hErr))
+	assertEq(t, "requests without retry", 1, n)
+
+	n = 0
+	c.Retry.RetryNonIdempotent = true
+	ticket, err = c.Upload("kitten.jpg", []byte(jpegPhoto), map[string]string{})
+	assertOK(t, "upload retrying non-idempotent", err)
+	assertEq(t, "ticket retrying non-idempotent", "363", ticket)
+	assertEq(t, "requests retrying non-idempotent", 2, n)
+}
+
+func TestRetryNonIdempotentCall(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	n := 0
+	c := newClient(newSequenceClient(&n,
+		[]int{503, 200}, []string{"unavailable", `<rsp stat="ok"/>`}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	err := c.Call("flickr.photosets.create", nil, true, nil)
+	var hErr *HTTPError
+	assert(t, "http error", errors.As(err, &hErr))
+	assertEq(t, "requests without retry", 1, n)
+
+	n = 0
+	assertOK(t, "CallIdempotent", c.CallIdempotent("flickr.test.echo", nil, true, nil))
+	assertEq(t, "requests with retry", 2, n)
+
+	n = 0
+	c = newClient(newSequenceClient(&n,
+		[]int{200, 200}, []string{unavailableXML, `<rsp stat="ok"/>`}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	assertOK(t, "Call", c.Call("flickr.photosets.create", nil, true, nil))
+	assertEq(t, "requests retrying code 105", 2, n)
+}
+
+func TestRetrySignsAfresh(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	count := 0
+	origNonce := nonce
+	nonce = func() string {
+		count++
+		return fmt.Sprintf("nonce%d", count)
+	}
+	defer func() { nonce = origNonce }()
+
+	var nonces []string
+	getFn := func(r *http.Request) (*http.Response, error) {
+		nonces = append(nonces, r.URL.Query().Get("oauth_nonce"))
+		status, body := http.StatusServiceUnavailable, "unavailable"
+		if len(nonces) > 1 {
+			status, body = http.StatusOK, setsXML
+		}
+		return &http.Response{StatusCode: status,
+			Body: ioutil.NopCloser(strings.NewReader(body))}, nil
+	}
+	c := newClient(newHTTPClient(getFn))
+	c.OAuthToken, c.OAuthTokenSecret = "tok", "toksecret"
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	_, err := c.GetSets("me")
+	assertOK(t, "GetSets", err)
+	assertEq(t, "nonces", "nonce1 nonce2", strings.Join(nonces, " "))
+
+	req, rqErr := multipartRequest(c, uploadURL, "kitten.jpg", strings.NewReader(jpegPhoto), int64(len(jpegPhoto)),
+		map[string]string{}, nil)
+	assertOK(t, "multipartRequest", rqErr)
+	first, _ := ioutil.ReadAll(req.Body)
+	body, gErr := req.GetBody()
+	assertOK(t, "GetBody", gErr)
+	second, _ := ioutil.ReadAll(body)
+	assert(t, "first nonce", strings.Contains(string(first), "nonce3"))
+	assert(t, "second nonce", strings.Contains(string(second), "nonce4"))
+	assertEq(t, "length", req.ContentLength, int64(len(second)))
+}
+
+func TestRetryCancelled(t *testing.T) {
+	n := 0
+	c := newClient(newSequenceClient(&n, []int{200}, []string{unavailableXML}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := c.WithContext(ctx).GetSets("me")
+	assert(t, "cancelled", errors.Is(err, context.Canceled))
+	assertEq(t, "requests", 1, n)
+}
+
+//-----------------------
+// Tests for ratelimit.go
+//
+
+// Replaces limiterNow and sleep with a fake clock that advances only when
+// sleep is called, until the returned function is called.
+func fakeClock() func() {
+	origNow, origSleep := limiterNow, sleep
+	t := time.Unix(1305586162, 0)
+	limiterNow = func() time.Time { return t }
+	sleep = func(ctx context.Context, d time.Duration) error {
+		t = t.Add(d)
+		return ctx.Err()
+	}
+	return func() {
+		limiterNow, sleep = origNow, origSleep
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	defer fakeClock()()
+	start := limiterNow()
+	b := NewTokenBucket(3600, 600)
+	assertEq(t, "initial", 600, b.Remaining())
+	for i := 0; i < 600; i++ {
+		assertOK(t, "burst wait", b.Wait(context.Background()))
+	}
+	assertEq(t, "after burst", 0, b.Remaining())
+	assertEq(t, "burst time", time.Duration(0), limiterNow().Sub(start))
+
+	// 3000 more calls have to be spread across the rest of the hour.
+	for i := 0; i < 3000; i++ {
+		assertOK(t, "wait", b.Wait(context.Background()))
+	}
+	elapsed := limiterNow().Sub(start)
+	assert(t, fmt.Sprintf("elapsed %v", elapsed),
+		elapsed > 59*time.Minute && elapsed <= time.Hour)
+
+	// Tokens accumulate while the bucket is idle, up to its capacity.
+	sleep(context.Background(), time.Minute)
+	assertEq(t, "after a minute", 50, b.Remaining())
+	sleep(context.Background(), 24*time.Hour)
+	assertEq(t, "after a day", 600, b.Remaining())
+}
+
+func TestTokenBucketCancelled(t *testing.T) {
+	defer fakeClock()()
+	b := NewTokenBucket(3600, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	assertOK(t, "first", b.Wait(ctx))
+	cancel()
+	assert(t, "cancelled", errors.Is(b.Wait(ctx), context.Canceled))
+}
+
+func TestSharedLimiter(t *testing.T) {
+	c1 := New("shared-key", secret, nil)
+	c2 := New("shared-key", secret, nil)
+	c3 := New("other-key", secret, nil)
+	assert(t, "same key", c1.Limiter == c2.Limiter)
+	assert(t, "different key", c1.Limiter != c3.Limiter)
+	assert(t, "WithContext", c1.WithContext(context.Background()).Limiter == c1.Limiter)
+}
+
+// Limiter that counts calls to Wait and refuses them after max calls.
+type countingLimiter struct {
+	calls, max int
+}
+
+func (l *countingLimiter) Wait(ctx context.Context) error {
+	l.calls++
+	if l.calls > l.max {
+		return errors.New("quota exhausted")
+	}
+	return nil
+}
+
+func (l *countingLimiter) Remaining() int {
+	if l.calls >= l.max {
+		return 0
+	}
+	return l.max - l.calls
+}
+
+func TestClientLimiter(t *testing.T) {
+	n := 0
+	c := newClient(newSequenceClient(&n, []int{200}, []string{setsXML}))
+	l := &countingLimiter{max: 2}
+	c.Limiter = l
+	assertEq(t, "remaining", 2, c.RemainingCalls())
+	_, err := c.GetSets("me")
+	assertOK(t, "GetSets", err)
+	assertEq(t, "remaining after call", 1, c.RemainingCalls())
+	_, err = c.Upload("kitten.jpg", []byte(jpegPhoto), map[string]string{})
+	assertOK(t, "Upload", err)
+	_, err = c.GetSets("me")
+	assert(t, "limited", err != nil && strings.Contains(err.Error(), "quota exhausted"))
+	assertEq(t, "waits", 3, l.calls)
+	assertEq(t, "requests", 2, n)
+
+	c.Limiter = nil
+	assertEq(t, "no limiter", -1, c.RemainingCalls())
+}
+
+func TestUploadLimiterFailureStopsWriter(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	n := 0
+	c := newClient(newSequenceClient(&n, []int{200}, []string{unavailableXML}))
+	c.Retry = &RetryPolicy{MaxAttempts: 3}
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		// The limiter refuses the first attempt of even uploads, and the
+		// retry of odd ones.
+		c.Limiter = &countingLimiter{max: i % 2}
+		_, err := c.UploadReader("kitten.jpg", strings.NewReader(jpegPhoto), -1,
+			map[string]string{})
+		assert(t, "limited", err != nil && strings.Contains(err.Error(), "quota exhausted"))
+	}
+	assertEq(t, "requests", 10, n)
+
+	// The writer goroutines exit shortly after their bodies are closed.
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assertEq(t, "goroutines", before, runtime.NumGoroutine())
+}
+
+//-----------------------
+// Tests for tickets.go
+//
+
+// Returns an HTTP client that responds to checkTickets requests as if ticket
+// "tN" completes with photo ID "pN" on the Nth check, ticket "bad" is
+// invalid, and ticket "failed" fails.  batches records the number of tickets
+// in each request.
+func newTicketsClient(t *testing.T, batches *[]int) *http.Client {
+	checks := make(map[string]int)
+	return newHTTPClient(func(r *http.Request) (*http.Response, error) {
+		assertEq(t, "method", "flickr.photos.upload.checkTickets", r.URL.Query().Get("method"))
+		ids := strings.Split(r.URL.Query().Get("tickets"), ",")
+		*batches = append(*batches, len(ids))
+		xmlStr := `<rsp stat="ok"><uploader>`
+		for _, id := range ids {
+			checks[id]++
+			var n int
+			fmt.Sscanf(id, "t%d", &n)
+			switch {
+			case id == "bad":
+				xmlStr += `<ticket id="bad" invalid="1"/>`
+			case id == "failed":
+				xmlStr += `<ticket id="failed" complete="2"/>`
+			case checks[id] >= n:
+				xmlStr += fmt.Sprintf(`<ticket id="%s" complete="1" photoid="p%d"/>`, id, n)
+			default:
+				xmlStr += fmt.Sprintf(`<ticket id="%s" complete="0"/>`, id)
+			}
+		}
+		xmlStr += `</uploader></rsp>`
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	})
+}
+
+func TestWaitForTickets(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	var batches []int
+	c := newClient(newTicketsClient(t, &batches))
+
+	tickets := []string{"bad", "failed", "t1", "t3", "t3"}
+	for i := 0; i < 60; i++ {
+		tickets = append(tickets, "t2")
+	}
+	results, err := c.WaitForTickets(tickets)
+	assertOK(t, "WaitForTickets", err)
+	assertEq(t, "len(results)", 5, len(results))
+	assertEq(t, "bad", ErrInvalidTicket, results["bad"].Err)
+	assertEq(t, "failed", ErrUploadFailed, results["failed"].Err)
+	assertEq(t, "t1", TicketResult{PhotoID: "p1"}, results["t1"])
+	assertEq(t, "t2", TicketResult{PhotoID: "p2"}, results["t2"])
+	assertEq(t, "t3", TicketResult{PhotoID: "p3"}, results["t3"])
+
+	assertEq(t, "len(delays)", 3, len(delays))
+	assertEq(t, "delay 0", time.Second, delays[0])
+	assertEq(t, "delay 1", 3*time.Second/2, delays[1])
+	assertEq(t, "len(batches)", 3, len(batches))
+	assertEq(t, "batch 0", 5, batches[0])
+	assertEq(t, "batch 1", 2, batches[1])
+	assertEq(t, "batch 2", 1, batches[2])
+}
+
+func TestWaitForTicketsBatches(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	var batches []int
+	c := newClient(newTicketsClient(t, &batches))
+
+	var tickets []string
+	for i := 0; i < 120; i++ {
+		tickets = append(tickets, fmt.Sprintf("t1-%d", i))
+	}
+	results, err := c.WaitForTickets(tickets)
+	assertOK(t, "WaitForTickets", err)
+	assertEq(t, "len(results)", 120, len(results))
+	assertEq(t, "len(batches)", 3, len(batches))
+	assertEq(t, "batch 0", maxTicketsPerCheck, batches[0])
+	assertEq(t, "batch 2", 20, batches[2])
+}
+
+func TestWaitForTicketsDeadline(t *testing.T) {
+	var batches []int
+	c := newClient(newTicketsClient(t, &batches))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	results, err := c.WithContext(ctx).WaitForTickets([]string{"t100", "bad"})
+	assert(t, "err", errors.Is(err, context.DeadlineExceeded))
+	assertEq(t, "len(results)", 2, len(results))
+	assert(t, "pending", errors.Is(results["t100"].Err, context.DeadlineExceeded))
+}
+
+//-----------------------
+// Tests for contenttype.go
+//
+
+func TestSniffContentType(t *testing.T) {
+	ts := make([]byte, 2*188)
+	ts[0], ts[188] = 0x47, 0x47
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF\x00"), "image/jpeg"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "image/png"},
+		{"gif", []byte("GIF89a\x01\x00\x01\x00"), "image/gif"},
+		{"tiff", []byte("II*\x00\x08\x00\x00\x00"), "image/tiff"},
+		{"heic", []byte("\x00\x00\x00\x18ftypheic\x00\x00\x00\x00"), "image/heic"},
+		{"mp4", []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00"), "video/mp4"},
+		{"m4v", []byte("\x00\x00\x00\x18ftypM4V \x00\x00\x02\x00"), "video/mp4"},
+		{"avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), "image/avif"},
+		{"m4a", []byte("\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00"), "audio/mp4"},
+		{"other ftyp", []byte("\x00\x00\x00\x1cftypabcd\x00\x00\x00\x00"), "application/mp4"},
+		{"mov", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00"), "video/quicktime"},
+		{"3gp", []byte("\x00\x00\x00\x14ftyp3gp5\x00\x00\x02\x00"), "video/3gpp"},
+		{"avi", []byte("RIFF\x00\x00\x00\x00AVI LIST"), "video/x-msvideo"},
+		{"wmv", append(append([]byte{}, asfHeader...), 0, 0), "video/x-ms-wmv"},
+		{"mpeg", []byte("\x00\x00\x01\xba\x44\x00"), "video/mpeg"},
+		{"ts", ts, "video/mp2t"},
+		{"ogg", []byte("OggS\x00\x02\x00\x00"), "video/ogg"},
+		{"text", []byte("hello"), "text/plain; charset=utf-8"},
+		{"empty", nil, "application/octet-stream"},
+	}
+	for _, tt := range tests {
+		assertEq(t, tt.name, tt.want, sniffContentType(tt.head))
+	}
+}
+
+func TestDetectContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	ct, err := detectContentType("IMG_001", png)
+	assertOK(t, "no extension", err)
+	assertEq(t, "no extension", "image/png", ct)
+
+	ct, err = detectContentType("IMG_001.jpg", png)
+	assertOK(t, "wrong extension", err)
+	assertEq(t, "wrong extension", "image/png", ct)
+
+	ct, err = detectContentType("clip.MOV", []byte("\x00\x01unknown"))
+	assertOK(t, "extension", err)
+	assertEq(t, "extension", "video/quicktime", ct)
+
+	_, err = detectContentType("doc.jpg", []byte("%PDF-1.4\n"))
+	assert(t, "pdf", errors.Is(err, ErrUnsupportedType))
+
+	_, err = detectContentType("image.avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"))
+	assert(t, "avif", errors.Is(err, ErrUnsupportedType))
+
+	_, err = detectContentType("notes.jpg", []byte("Dear diary"))
+	assert(t, "text", errors.Is(err, ErrUnsupportedType))
+
+	_, err = detectContentType("song.mp4", []byte("\x00\x00\x00\x1cftypM4A \x00\x00\x00\x00"))
+	assert(t, "audio", errors.Is(err, ErrUnsupportedType))
+
+	_, err = detectContentType("notes.txt", []byte("hello"))
+	assert(t, "unsupported", errors.Is(err, ErrUnsupportedType))
+	assert(t, "message: "+err.Error(), strings.Contains(err.Error(), "notes.txt"))
+}
+
+func TestUploadUnsupportedType(t *testing.T) {
+	c := newClient(newHTTPClient(func(r *http.Request) (*http.Response, error) {
+		t.Error("unexpected request")
+		return nil, errors.New("unexpected request")
+	}))
+	_, err := c.UploadReader("IMG_001", strings.NewReader("%PDF-1.4"), -1,
+		map[string]string{})
+	assert(t, "err", errors.Is(err, ErrUnsupportedType))
+}
+
+func TestUploadRequestSniffed(t *testing.T) {
+	c := newClient(nil)
+	data := "\x00\x00\x00\x18ftypheic\x00\x00\x00\x00 image data"
+	req, rqErr := multipartRequest(c, uploadURL, "IMG_001", strings.NewReader(data),
+		int64(len(data)), map[string]string{}, nil)
+	assertOK(t, "multipartRequest", rqErr)
+	assertOK(t, "parseForm", req.ParseMultipartForm(1024))
+	fh := req.MultipartForm.File["photo"][0]
+	assertEq(t, "filetype", "image/heic", fh.Header.Get("Content-Type"))
+	file, oErr := fh.Open()
+	assertOK(t, "file open", oErr)
+	actual, _ := ioutil.ReadAll(file)
+	assertEq(t, "photo", data, string(actual))
+}
+
+//-----------------------
+// Tests for bulk.go
+//
+
+// Returns an HTTP client for BulkUpload and SyncDir: uploads get a ticket or
+// fail according to the file name, tickets are checked by newTicketsClient,
+// and photos added to sets and sets created are appended to added.  Adding
+// a photo that is already in added fails with ErrPhotoAlreadyInSet.
+func newBulkClient(t *testing.T, added *[]string) *http.Client {
+	var batches []int
+	tickets := newTicketsClient(t, &batches)
+	var mu sync.Mutex
+	return newHTTPClient(func(r *http.Request) (*http.Response, error) {
+		var xmlStr string
+		switch {
+		case r.Method == "POST" && r.URL.String() == service+"/rest/":
+			if err := r.ParseForm(); err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			switch m := r.PostForm.Get("method"); m {
+			case "flickr.photosets.create":
+				*added = append(*added, "create:"+r.PostForm.Get("primary_photo_id"))
+				xmlStr = `<rsp stat="ok"><photoset id="s9"/></rsp>`
+			case "flickr.photosets.addPhoto":
+				id := r.PostForm.Get("photo_id")
+				xmlStr = `<rsp stat="ok"></rsp>`
+				for _, a := range *added {
+					if a == id {
+						xmlStr = `<rsp stat="fail"><err code="3" msg="Photo already in set"/></rsp>`
+					}
+				}
+				*added = append(*added, id)
+			default:
+				t.Errorf("unexpected method %s", m)
+			}
+			mu.Unlock()
+		case r.Method == "POST":
+			if err := r.ParseMultipartForm(1024); err != nil {
+				return nil, err
+			}
+			switch name := r.MultipartForm.File["photo"][0].Filename; name {
+			case "sync.jpg":
+				xmlStr = `<rsp stat="ok"><photoid>p9</photoid></rsp>`
+			case "rejected.jpg":
+				xmlStr = `<rsp stat="fail"><err code="5" msg="Filetype was not recognised"/></rsp>`
+			default:
+				xmlStr = fmt.Sprintf(`<rsp stat="ok"><ticketid>%s</ticketid></rsp>`,
+					strings.TrimSuffix(name, ".jpg"))
+			}
+		case r.URL.Query().Get("method") == "flickr.photosets.getList":
+			xmlStr = `<rsp stat="ok"><photosets>
+			  <photoset id="s1"><title>Holiday</title></photoset>
+			</photosets></rsp>`
+		default:
+			return tickets.Transport.RoundTrip(r)
+		}
+		return &http.Response{Body: ioutil.NopCloser(strings.NewReader(xmlStr))}, nil
+	})
+}
+
+func bulkJob(name string) UploadJob {
+	return UploadJob{
+		Name: name,
+		Open: func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(strings.NewReader(jpegPhoto)), nil
+		},
+		Size: int64(len(jpegPhoto)),
+	}
+}
+
+func TestBulkUpload(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	var added []string
+	c := newClient(newBulkClient(t, &added))
+
+	jobs := make(chan UploadJob)
+	go func() {
+		for _, name := range []string{"t1.jpg", "failed.jpg", "rejected.jpg", "t2.jpg"} {
+			jobs <- bulkJob(name)
+		}
+		syncJob := bulkJob("sync.jpg")
+		syncJob.Options = &UploadOptions{Sync: true}
+		jobs <- syncJob
+		jobs <- UploadJob{Name: "missing.jpg", Open: func() (io.ReadCloser, error) {
+			return nil, os.ErrNotExist
+		}}
+		close(jobs)
+	}()
+	s := c.BulkUpload(jobs, &BulkOptions{Workers: 3, SetID: "set1"})
+
+	assertEq(t, "succeeded", 3, s.Succeeded)
+	assertEq(t, "failed", 3, s.Failed)
+	assertEq(t, "len(results)", 6, len(s.Results))
+	want := []string{"p1", "", "", "p2", "p9", ""}
+	for i, r := range s.Results {
+		assertEq(t, r.Name, want[i], r.PhotoID)
+	}
+	assert(t, "failed", errors.Is(s.Results[1].Err, ErrUploadFailed))
+	var fErr *Error
+	assert(t, "rejected", errors.As(s.Results[2].Err, &fErr) && fErr.Code == 5)
+	assert(t, "missing", errors.Is(s.Results[5].Err, os.ErrNotExist))
+	assertEq(t, "added", "p1 p2 p9", strings.Join(added, " "))
+}
+
+func TestBulkUploadCancelled(t *testing.T) {
+	var added []string
+	c := newClient(newBulkClient(t, &added))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	jobs := make(chan UploadJob, 2)
+	jobs <- bulkJob("t1.jpg")
+	jobs <- bulkJob("t2.jpg")
+	close(jobs)
+	s := c.WithContext(ctx).BulkUpload(jobs, nil)
+	assertEq(t, "failed", 2, s.Failed)
+	assert(t, "err", errors.Is(s.Results[0].Err, context.Canceled))
+}
+
+func TestFileJob(t *testing.T) {
+	f, err := ioutil.TempFile("", "flickgo*.jpg")
+	assertOK(t, "TempFile", err)
+	defer os.Remove(f.Name())
+	f.WriteString("photo data")
+	f.Close()
+
+	job, jErr := FileJob(f.Name(), nil)
+	assertOK(t, "FileJob", jErr)
+	assertEq(t, "name", filepath.Base(f.Name()), job.Name)
+	assertEq(t, "size", int64(10), job.Size)
+	r, oErr := job.Open()
+	assertOK(t, "open", oErr)
+	defer r.Close()
+	data, _ := ioutil.ReadAll(r)
+	assertEq(t, "data", "photo data", string(data))
+
+	_, jErr = FileJob(f.Name()+".missing", nil)
+	assert(t, "missing", errors.Is(jErr, os.ErrNotExist))
+}
+
+//-----------------------
+// Tests for dirsync.go
+//
+
+// Creates a temporary directory containing the given files.
+func syncTestDir(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "flickgo")
+	assertOK(t, "TempDir", err)
+	for name, data := range files {
+		assertOK(t, name, ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644))
+	}
+	return dir
+}
+
+func TestSyncDir(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	dir := syncTestDir(t, map[string]string{
+		"t1.jpg":    jpegHead + "photo 1",
+		"t9.jpg":    jpegHead + "photo 1",
+		"t2.jpg":    jpegHead + "photo 2",
+		"notes.txt": "notes",
+		".hidden":   "hidden",
+	})
+	defer os.RemoveAll(dir)
+	var added []string
+	c := newClient(newBulkClient(t, &added))
+
+	opts := &SyncOptions{SetTitle: "New", CreateSet: true, Workers: 1}
+	s, err := c.SyncDir(dir, opts)
+	assertOK(t, "SyncDir", err)
+	assertEq(t, "set", "s9", s.SetID)
+	assertEq(t, "uploaded", 2, len(s.Uploaded))
+	assertEq(t, "failed", 0, s.Failed)
+	assertEq(t, "skipped", "t9.jpg", strings.Join(s.Skipped, " "))
+	assertEq(t, "unsupported", "notes.txt", strings.Join(s.Unsupported, " "))
+	assertEq(t, "added", "create:p1 p2", strings.Join(added, " "))
+
+	st, lErr := loadSyncState(filepath.Join(dir, DefaultSyncStateFile))
+	assertOK(t, "loadSyncState", lErr)
+	assertEq(t, "state set", "s9", st.SetID)
+	assertEq(t, "state photos", 2, len(st.Photos))
+	assertEq(t, "state unsorted", 0, len(st.Unsorted))
+
+	// A second run uploads only the new file.
+	ioutil.WriteFile(filepath.Join(dir, "t3.jpg"), []byte(jpegHead+"photo 3"), 0644)
+	added = nil
+	s, err = c.SyncDir(dir, opts)
+	assertOK(t, "second SyncDir", err)
+	assertEq(t, "second uploaded", 1, len(s.Uploaded))
+	assertEq(t, "second photo", "p3", s.Uploaded[0].PhotoID)
+	assertEq(t, "second skipped", 3, len(s.Skipped))
+	assertEq(t, "second added", "p3", strings.Join(added, " "))
+}
+
+func TestSyncDirPendingTickets(t *testing.T) {
+	var delays []time.Duration
+	defer recordSleeps(&delays)()
+	dir := syncTestDir(t, map[string]string{
+		"t1.jpg":  jpegHead + "photo 1",
+		"t2.jpg":  jpegHead + "photo 2",
+		"bad.jpg": jpegHead + "photo 3",
+	})
+	defer os.RemoveAll(dir)
+	var added []string
+	bulk := newBulkClient(t, &added)
+	failChecks := true
+	uploads := 0
+	c := newClient(newHTTPClient(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Query().Get("method") == "flickr.photos.upload.checkTickets" && failChecks {
+			return nil, errors.New("network down")
+		}
+		if r.URL.String() == uploadURL {
+			uploads++
+		}
+		return bulk.Transport.RoundTrip(r)
+	}))
+
+	// The tickets are saved even though waiting for them fails.
+	opts := &SyncOptions{SetTitle: "New", CreateSet: true, Workers: 1}
+	s, err := c.SyncDir(dir, opts)
+	assertOK(t, "SyncDir", err)
+	assertEq(t, "failed", 3, s.Failed)
+	assertEq(t, "uploads", 3, uploads)
+	st, lErr := loadSyncState(filepath.Join(dir, DefaultSyncStateFile))
+	assertOK(t, "loadSyncState", lErr)
+	assertEq(t, "state tickets", 3, len(st.Tickets))
+	assertEq(t, "state photos", 0, len(st.Photos))
+
+	// The next run resolves them, and uploads again only the file whose
+	// ticket is invalid.
+	failChecks = false
+	uploads = 0
+	s, err = c.SyncDir(dir, opts)
+	assertOK(t, "second SyncDir", err)
+	assertEq(t, "second uploads", 1, uploads)
+	assertEq(t, "second uploaded", 1, len(s.Uploaded))
+	assertEq(t, "second name", "bad.jpg", s.Uploaded[0].Name)
+	assert(t, "invalid ticket", errors.Is(s.Uploaded[0].Err, ErrInvalidTicket))
+	assertEq(t, "added", "create:p1 p2", strings.Join(added, " "))
+	st, lErr = loadSyncState(filepath.Join(dir, DefaultSyncStateFile))
+	assertOK(t, "second loadSyncState", lErr)
+	assertEq(t, "second state tickets", 0, len(st.Tickets))
+	assertEq(t, "second state photos", 2, len(st.Photos))
+}
+
+func TestSyncDirAlreadyInSet(t *testing.T) {
+	dir := syncTestDir(t, nil)
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, DefaultSyncStateFile)
+	// An earlier run added p1 to the set, but stopped before saving that.
+	st := &SyncState{SetID: "s1", Photos: map[string]string{"h1": "p1"},
+		Unsorted: []string{"p1"}}
+	assertOK(t, "saveSyncState", saveSyncState(statePath, st))
+	added := []string{"p1"}
+	c := newClient(newBulkClient(t, &added))
+
+	_, err := c.SyncDir(dir, &SyncOptions{SetID: "s1"})
+	assertOK(t, "SyncDir", err)
+	st, lErr := loadSyncState(statePath)
+	assertOK(t, "loadSyncState", lErr)
+	assertEq(t, "state unsorted", 0, len(st.Unsorted))
+}
+
+func TestSyncDirExistingSet(t *testing.T) {
+	dir := syncTestDir(t, nil)
+	defer os.RemoveAll(dir)
+	var added []string
+	c := newClient(newBulkClient(t, &added))
+
+	s, err := c.SyncDir(dir, &SyncOptions{SetTitle: "Holiday"})
+	assertOK(t, "SyncDir", err)
+	assertEq(t, "set", "s1", s.SetID)
+
+	_, err = c.SyncDir(dir, &SyncOptions{SetTitle: "Missing",
+		StateFile: filepath.Join(dir, "other.json")})
+	assert(t, "missing set", err != nil && strings.Contains(err.Error(), `"Missing" not found`))
+}
+
+//-----------------------
+// Tests for exif.go
+//
+
+func TestExifAccessors(t *testing.T) {
+	e := &Exif{Tags: []ExifTag{
+		{Tag: "Make", Raw: "Canon"},
+		{Tag: "Model", Raw: "Canon EOS 400D DIGITAL"},
+		{Tag: "LensModel", Raw: "EF50mm f/1.8 II"},
+		{Tag: "ExposureTime", Raw: "1/250", Clean: "0.004 sec (1/250)"},
+		{Tag: "ApertureValue", Raw: "6"},
+		{Tag: "FocalLength", Raw: "50.0 mm"},
+		{Tag: "ISO", Raw: "400"},
+		{Tag: "DateTimeOriginal", Raw: "2007:03:12 12:03:09"},
+	}}
+	assertEq(t, "make", "Canon", e.Make())
+	assertEq(t, "model", "Canon EOS 400D DIGITAL", e.Model())
+	assertEq(t, "lens", "EF50mm f/1.8 II", e.Lens())
+	assertEq(t, "value", "0.004 sec (1/250)", e.Get("ExposureTime").Value())
+
+	exposure, ok := e.ExposureTime()
+	assert(t, "exposure ok", ok)
+	assertEq(t, "exposure", 4*time.Millisecond, exposure)
+	aperture, ok := e.Aperture()
+	assert(t, "aperture ok", ok)
+	assertEq(t, "aperture", 8.0, aperture)
+	focal, ok := e.FocalLength()
+	assert(t, "focal length ok", ok)
+	assertEq(t, "focal length", 50.0, focal)
+	iso, ok := e.ISO()
+	assert(t, "iso ok", ok)
+	assertEq(t, "iso", 400, iso)
+	taken, ok := e.DateTaken()
+	assert(t, "date taken ok", ok)
+	assertEq(t, "date taken", time.Date(2007, 3, 12, 12, 3, 9, 0, time.UTC), taken)
+
+	e.Tags = append(e.Tags, ExifTag{Tag: "FNumber", Raw: "5.6"})
+	aperture, _ = e.Aperture()
+	assertEq(t, "f-number", 5.6, aperture)
+
+	empty := &Exif{}
+	_, ok = empty.ExposureTime()
+	assert(t, "no exposure", !ok)
+	_, ok = empty.ISO()
+	assert(t, "no iso", !ok)
+	assert(t, "no tag", empty.Get("Make") == nil)
+}
@@ -0,0 +1,255 @@
+package flickgo
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flickr's OAuth endpoints.  See
+// https://www.flickr.com/services/api/auth.oauth.html.
+const (
+	requestTokenURL = "https://www.flickr.com/services/oauth/request_token"
+	authorizeURL    = "https://www.flickr.com/services/oauth/authorize"
+	accessTokenURL  = "https://www.flickr.com/services/oauth/access_token"
+)
+
+// Callback value to use for apps that cannot receive a callback (desktop and
+// command line apps, for example).  Flickr then shows the verifier to the user,
+// who has to copy it into the app.
+const OutOfBandCallback = "oob"
+
+// Returns the current time; replaced in tests.
+var now = time.Now
+
+// Returns a random OAuth nonce; replaced in tests.
+var nonce = func() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// An OAuth token along with the secret used for signing requests made with it.
+type RequestToken struct {
+	Token  string
+	Secret string
+}
+
+// An OAuth access token for acting on behalf of User.  Set the Token and
+// Secret values as Client's OAuthToken and OAuthTokenSecret.
+type AccessToken struct {
+	Token  string
+	Secret string
+	User   User
+}
+
+// Percent-encodes s as specified in section 3.6 of RFC 5849.
+func oauthEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// Returns the OAuth 1.0a HMAC-SHA1 signature for a request.  httpMethod and
+// baseURL identify the request; args contains all query and form arguments
+// including the oauth_* ones.
+func oauthSign(httpMethod, baseURL string, args map[string]string,
+	consumerSecret, tokenSecret string) string {
+	ks := keys(args)
+	ks.Sort()
+	params := make([]string, len(ks))
+	for i, k := range ks {
+		params[i] = oauthEscape(k) + "=" + oauthEscape(args[k])
+	}
+	base := strings.Join([]string{
+		httpMethod,
+		oauthEscape(baseURL),
+		oauthEscape(strings.Join(params, "&")),
+	}, "&")
+	key := oauthEscape(consumerSecret) + "&" + oauthEscape(tokenSecret)
+	m := hmac.New(sha1.New, []byte(key))
+	m.Write([]byte(base))
+	return base64.StdEncoding.EncodeToString(m.Sum(nil))
+}
+
+// Returns a copy of args with the OAuth protocol parameters and signature
+// added.  token may be empty for requests that are signed with the consumer
+// secret alone.
+func oauthArgs(c *Client, httpMethod, baseURL string, args map[string]string,
+	token, tokenSecret string) map[string]string {
+	a := clone(args)
+	a["oauth_consumer_key"] = c.apiKey
+	a["oauth_nonce"] = nonce()
+	a["oauth_timestamp"] = strconv.FormatInt(now().Unix(), 10)
+	a["oauth_signature_method"] = "HMAC-SHA1"
+	a["oauth_version"] = "1.0"
+	if token != "" {
+		a["oauth_token"] = token
+	}
+	a["oauth_signature"] = oauthSign(httpMethod, baseURL, a, c.secret, tokenSecret)
+	return a
+}
+
+// Returns baseURL with args and the OAuth parameters added to the query
+// string, signed for a GET request.
+func oauthURL(c *Client, baseURL string, args map[string]string,
+	token, tokenSecret string) string {
+	a := oauthArgs(c, "GET", baseURL, args, token, tokenSecret)
+	return baseURL + "?" + queryValues(a).Encode()
+}
+
+// Sends a GET request to one of the OAuth endpoints and returns the
+// form-encoded values in its response.
+func fetchOAuthValues(c *Client, u string) (url.Values, error) {
+	if c.Logger != nil {
+		c.Logger.Debugf("GET %v\n", u)
+	}
+	in, err := fetch(c, u)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	body, rErr := ioutil.ReadAll(in)
+	if rErr != nil {
+		return nil, wrapErr("reading response failed", rErr)
+	}
+	if c.Logger != nil {
+		c.Logger.Debugf("Parsing OAuth response %s", string(body))
+	}
+	vals, pErr := url.ParseQuery(string(body))
+	if pErr != nil {
+		return nil, wrapErr("OAuth response parsing failed", pErr)
+	}
+	if p := vals.Get("oauth_problem"); p != "" {
+		return nil, fmt.Errorf("OAuth error: %s", p)
+	}
+	if vals.Get("oauth_token") == "" {
+		return nil, fmt.Errorf("OAuth response has no token: %s", string(body))
+	}
+	return vals, nil
+}
+
+// Returns the signed URL for obtaining an OAuth request token.
+func requestTokenRequestURL(c *Client, callback string) string {
+	args := map[string]string{"oauth_callback": callback}
+	return oauthURL(c, requestTokenURL, args, "", "")
+}
+
+// Obtains a request token, which is the first step of Flickr's OAuth flow.
+// Flickr redirects the user to callback after they authorise the app; pass
+// OutOfBandCallback if the app cannot receive a callback.  See
+// https://www.flickr.com/services/api/auth.oauth.html.
+func (c *Client) GetRequestToken(callback string) (*RequestToken, error) {
+	vals, err := fetchOAuthValues(c, requestTokenRequestURL(c, callback))
+	if err != nil {
+		return nil, wrapErr("request token failed", err)
+	}
+	if vals.Get("oauth_callback_confirmed") != "true" {
+		return nil, fmt.Errorf("request token failed: callback not confirmed")
+	}
+	return &RequestToken{
+		Token:  vals.Get("oauth_token"),
+		Secret: vals.Get("oauth_token_secret"),
+	}, nil
+}
+
+// Returns the URL for requesting the user to authorise the app to access
+// their account with the given request token.  perms is one of ReadPerm,
+// WritePerm and DeletePerm.
+func (c *Client) AuthorizeURL(requestToken string, perms string) string {
+	args := make(url.Values)
+	args.Set("oauth_token", requestToken)
+	args.Set("perms", perms)
+	return authorizeURL + "?" + args.Encode()
+}
+
+// Returns the signed URL for exchanging a request token for an access token.
+func accessTokenRequestURL(c *Client, rt *RequestToken, verifier string) string {
+	args := map[string]string{"oauth_verifier": verifier}
+	return oauthURL(c, accessTokenURL, args, rt.Token, rt.Secret)
+}
+
+// Exchanges an authorised request token for an access token, which is valid
+// until the user revokes it.  verifier is the oauth_verifier value Flickr
+// passed to the callback URL (or showed to the user for out-of-band
+// callbacks).
+func (c *Client) GetAccessToken(rt *RequestToken, verifier string) (*AccessToken, error) {
+	vals, err := fetchOAuthValues(c, accessTokenRequestURL(c, rt, verifier))
+	if err != nil {
+		return nil, wrapErr("access token failed", err)
+	}
+	return &AccessToken{
+		Token:  vals.Get("oauth_token"),
+		Secret: vals.Get("oauth_token_secret"),
+		User: User{
+			UserName: vals.Get("username"),
+			NSID:     vals.Get("user_nsid"),
+			FullName: vals.Get("fullname"),
+		},
+	}, nil
+}
+
+// Returns the URL for flickr.auth.oauth.getAccessToken request, signed using
+// the legacy scheme with authToken.
+func migrateTokenURL(c *Client, authToken string) string {
+	args := map[string]string{
+		"method":     "flickr.auth.oauth.getAccessToken",
+		"auth_token": authToken,
+	}
+	return signedURL(c.secret, c.apiKey, "rest", args)
+}
+
+// Exchanges a token returned by GetToken for an OAuth access token.  Flickr
+// invalidates authToken once the exchange succeeds.  The User field of the
+// returned token is not populated.  Interface for
+// https://www.flickr.com/services/api/flickr.auth.oauth.getAccessToken.html
+// API method.
+func (c *Client) MigrateToken(authToken string) (*AccessToken, error) {
+	r := struct {
+		Token struct {
+			Token  string `xml:"oauth_token,attr"`
+			Secret string `xml:"oauth_token_secret,attr"`
+		} `xml:"auth>access_token"`
+	}{}
+	// Not idempotent: a retry after a lost response would fail, since Flickr
+	// has invalidated authToken by then.
+	if err := flickrGet(c, false, func() string {
+		return migrateTokenURL(c, authToken)
+	}, &r); err != nil {
+		return nil, err
+	}
+	return &AccessToken{Token: r.Token.Token, Secret: r.Token.Secret}, nil
+}
+
+// Result of migrating a single legacy token.
+type TokenMigration struct {
+	// The legacy token that was migrated.
+	AuthToken string
+
+	// The new OAuth token; nil if migration failed.
+	AccessToken *AccessToken
+
+	// Reason for the failure, if any.
+	Err error
+}
+
+// Exchanges each of authTokens for an OAuth access token by calling
+// MigrateToken.  A failure to migrate one token does not stop the others from
+// being migrated; the returned slice has one entry per token, in the same
+// order as authTokens.
+func (c *Client) MigrateTokens(authTokens []string) []TokenMigration {
+	results := make([]TokenMigration, len(authTokens))
+	for i, tok := range authTokens {
+		at, err := c.MigrateToken(tok)
+		results[i] = TokenMigration{AuthToken: tok, AccessToken: at, Err: err}
+	}
+	return results
+}
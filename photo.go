@@ -3,7 +3,11 @@
 package flickgo
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 )
 
 // Image sizes supported by Flickr.  See
@@ -20,32 +24,35 @@ const (
 
 // Response for photo search requests.
 type SearchResponse struct {
-	Page    string  `xml:"page,attr"`
-	Pages   string  `xml:"pages,attr"`
-	PerPage string  `xml:"perpage,attr"`
-	Total   string  `xml:"total,attr"`
-	Photos  []Photo `xml:"photo"`
+	Page    string  `xml:"page,attr" json:"page"`
+	Pages   string  `xml:"pages,attr" json:"pages"`
+	PerPage string  `xml:"perpage,attr" json:"perpage"`
+	Total   string  `xml:"total,attr" json:"total"`
+	Photos  []Photo `xml:"photo" json:"photo"`
 }
 
 // A Flickr user.
 type User struct {
-	UserName string `xml:"username,attr"`
-	NSID     string `xml:"nsid,attr"`
+	UserName string `xml:"username,attr" json:"username"`
+	NSID     string `xml:"nsid,attr" json:"nsid"`
+	FullName string `xml:"fullname,attr" json:"fullname"`
 }
 
 // Represents a Flickr photo.
 type Photo struct {
-	ID       string `xml:"id,attr"`
-	Owner    string `xml:"owner,attr"`
-	Secret   string `xml:"secret,attr"`
-	Server   string `xml:"server,attr"`
-	Farm     string `xml:"farm,attr"`
-	Title    string `xml:"title,attr"`
-	IsPublic string `xml:"ispublic,attr"`
-	WidthT   string `xml:"width_t,attr"`
-	HeightT  string `xml:"height_t,attr"`
+	ID       string `xml:"id,attr" json:"id"`
+	Owner    string `xml:"owner,attr" json:"owner"`
+	Secret   string `xml:"secret,attr" json:"secret"`
+	Server   string `xml:"server,attr" json:"server"`
+	Farm     string `xml:"farm,attr" json:"farm"`
+	Title    string `xml:"title,attr" json:"title"`
+	IsPublic string `xml:"ispublic,attr" json:"ispublic"`
+	WidthT   string `xml:"width_t,attr" json:"width_t"`
+	HeightT  string `xml:"height_t,attr" json:"height_t"`
+	// "1" for the primary photo of a set, in GetSetPhotos responses.
+	IsPrimary string `xml:"isprimary,attr" json:"isprimary"`
 	// Photo's aspect ratio: width divided by height.
-	Ratio float64
+	Ratio float64 `json:"-"`
 }
 
 // Returns the URL to this photo in the specified size.
@@ -58,40 +65,351 @@ func (p *Photo) URL(size string) string {
 		p.Farm, p.Server, p.ID, p.Secret, size)
 }
 
+// A size in which a photo or video is available, returned by GetSizes.
+type Size struct {
+	// Name of the size, like "Thumbnail", "Large 1600" or "Original".
+	Label  string `xml:"label,attr" json:"label"`
+	Width  string `xml:"width,attr" json:"width"`
+	Height string `xml:"height,attr" json:"height"`
+	// URL of the image or video file.
+	Source string `xml:"source,attr" json:"source"`
+	// URL of the Flickr page showing the photo in this size.
+	URL string `xml:"url,attr" json:"url"`
+	// "photo" or "video".
+	Media string `xml:"media,attr" json:"media"`
+}
+
+// Returns the dimensions of s, or false if they are not known.
+func (s *Size) dimensions() (int, int, bool) {
+	w, wErr := strconv.Atoi(s.Width)
+	h, hErr := strconv.Atoi(s.Height)
+	return w, h, wErr == nil && hErr == nil && w > 0 && h > 0
+}
+
+// Returns the largest of the photo sizes in sizes that fits in a box of width
+// by height pixels, or the smallest one if none fits.  A width or height of 0
+// means no limit in that direction.  Video sizes are ignored; returns nil if
+// there are no photo sizes with known dimensions.
+func BestSize(sizes []Size, width, height int) *Size {
+	var best, smallest *Size
+	bestArea, smallestArea := 0, 0
+	for i := range sizes {
+		s := &sizes[i]
+		w, h, ok := s.dimensions()
+		if !ok || (s.Media != "" && s.Media != "photo") {
+			continue
+		}
+		area := w * h
+		if smallest == nil || area < smallestArea {
+			smallest, smallestArea = s, area
+		}
+		fits := (width <= 0 || w <= width) && (height <= 0 || h <= height)
+		if fits && area > bestArea {
+			best, bestArea = s, area
+		}
+	}
+	if best == nil {
+		return smallest
+	}
+	return best
+}
+
+// Returns the size of this photo that best fits in a box of width by height
+// pixels, as chosen by BestSize from the sizes returned by GetSizes.
+func (p *Photo) BestSize(c *Client, width, height int) (*Size, error) {
+	sizes, err := c.GetSizes(p.ID)
+	if err != nil {
+		return nil, err
+	}
+	s := BestSize(sizes, width, height)
+	if s == nil {
+		return nil, fmt.Errorf("no photo sizes available for photo %s", p.ID)
+	}
+	return s, nil
+}
+
+// A photoset (album).  Owner and OwnerName are returned by GetSetInfo only.
 type PhotoSet struct {
-	ID          string `xml:"id,attr"`
-	Title       string `xml:"title"`
-	Description string `xml:"description"`
+	ID            string `xml:"id,attr" json:"id"`
+	Owner         string `xml:"owner,attr" json:"owner"`
+	OwnerName     string `xml:"username,attr" json:"username"`
+	Primary       string `xml:"primary,attr" json:"primary"`
+	Secret        string `xml:"secret,attr" json:"secret"`
+	Server        string `xml:"server,attr" json:"server"`
+	Farm          string `xml:"farm,attr" json:"farm"`
+	Photos        string `xml:"photos,attr" json:"photos"`
+	Videos        string `xml:"videos,attr" json:"videos"`
+	CountViews    string `xml:"count_views,attr" json:"count_views"`
+	CountComments string `xml:"count_comments,attr" json:"count_comments"`
+	CanComment    string `xml:"can_comment,attr" json:"can_comment"`
+	// Unix timestamps of when the set was created and last updated.
+	DateCreate  string `xml:"date_create,attr" json:"date_create"`
+	DateUpdate  string `xml:"date_update,attr" json:"date_update"`
+	Title       string `xml:"title" json:"title"`
+	Description string `xml:"description" json:"description"`
+}
+
+// Returns the URL to the primary photo of this set in the specified size.
+func (s *PhotoSet) PrimaryURL(size string) string {
+	p := Photo{ID: s.Primary, Secret: s.Secret, Server: s.Server, Farm: s.Farm}
+	return p.URL(size)
+}
+
+// Response for GetSetPhotos requests.
+type SetPhotosResponse struct {
+	ID        string  `xml:"id,attr" json:"id"`
+	Primary   string  `xml:"primary,attr" json:"primary"`
+	Owner     string  `xml:"owner,attr" json:"owner"`
+	OwnerName string  `xml:"ownername,attr" json:"ownername"`
+	Title     string  `xml:"title,attr" json:"title"`
+	Page      string  `xml:"page,attr" json:"page"`
+	Pages     string  `xml:"pages,attr" json:"pages"`
+	PerPage   string  `xml:"perpage,attr" json:"perpage"`
+	Total     string  `xml:"total,attr" json:"total"`
+	Photos    []Photo `xml:"photo" json:"photo"`
 }
 
 type LocationResponse struct {
-	Photo    string   `xml:"id,attr"`
-	Location Location `xml:"location"`
+	Photo    string   `xml:"id,attr" json:"id"`
+	Location Location `xml:"location" json:"location"`
 }
 
 type Location struct {
-	Latitude  string `xml:"latitude,attr"`
-	Longitude string `xml:"longitude,attr"`
-	Accuracy  string `xml:"accuracy,attr"`
-	Context   string `xml:"context,attr"`
-	PlaceID   string `xml:"place_id,attr"`
-	WOEID     string `xml:"woeid,attr"`
+	Latitude      string `xml:"latitude,attr" json:"latitude"`
+	Longitude     string `xml:"longitude,attr" json:"longitude"`
+	Accuracy      string `xml:"accuracy,attr" json:"accuracy"`
+	Context       string `xml:"context,attr" json:"context"`
+	PlaceID       string `xml:"place_id,attr" json:"place_id"`
+	WOEID         string `xml:"woeid,attr" json:"woeid"`
+	Neighbourhood Place  `xml:"neighbourhood" json:"neighbourhood"`
+	Locality      Place  `xml:"locality" json:"locality"`
+	County        Place  `xml:"county" json:"county"`
+	Region        Place  `xml:"region" json:"region"`
+	Country       Place  `xml:"country" json:"country"`
+}
+
+// A named place that contains a location.
+type Place struct {
+	Name    string `xml:",chardata" json:"_content"`
+	PlaceID string `xml:"place_id,attr" json:"place_id"`
+	WOEID   string `xml:"woeid,attr" json:"woeid"`
+}
+
+// Accuracy of the date a photo was taken, in PhotoDates.TakenGranularity.
+const (
+	GranularitySecond = "0"
+	GranularityMonth  = "4"
+	GranularityYear   = "6"
+	GranularityCirca  = "8"
+)
+
+// Detailed information about a photo, returned by GetPhotoInfo.
+type PhotoInfo struct {
+	ID             string `xml:"id,attr" json:"id"`
+	Secret         string `xml:"secret,attr" json:"secret"`
+	Server         string `xml:"server,attr" json:"server"`
+	Farm           string `xml:"farm,attr" json:"farm"`
+	DateUploaded   string `xml:"dateuploaded,attr" json:"dateuploaded"`
+	IsFavorite     string `xml:"isfavorite,attr" json:"isfavorite"`
+	License        string `xml:"license,attr" json:"license"`
+	SafetyLevel    string `xml:"safety_level,attr" json:"safety_level"`
+	Rotation       string `xml:"rotation,attr" json:"rotation"`
+	OriginalSecret string `xml:"originalsecret,attr" json:"originalsecret"`
+	OriginalFormat string `xml:"originalformat,attr" json:"originalformat"`
+	Views          string `xml:"views,attr" json:"views"`
+	// "photo" or "video".
+	Media             string      `xml:"media,attr" json:"media"`
+	Owner             PhotoOwner  `xml:"owner" json:"owner"`
+	Title             string      `xml:"title" json:"title"`
+	Description       string      `xml:"description" json:"description"`
+	Visibility        Visibility  `xml:"visibility" json:"visibility"`
+	Dates             PhotoDates  `xml:"dates" json:"dates"`
+	Permissions       Permissions `xml:"permissions" json:"permissions"`
+	Editability       Editability `xml:"editability" json:"editability"`
+	PublicEditability Editability `xml:"publiceditability" json:"publiceditability"`
+	Comments          string      `xml:"comments" json:"comments"`
+	Notes             []Note      `xml:"notes>note" json:"notes"`
+	Tags              []Tag       `xml:"tags>tag" json:"tags"`
+	URLs              []PhotoURL  `xml:"urls>url" json:"urls"`
+	// Location is set only for geotagged photos.
+	Location *Location `xml:"location" json:"location"`
+}
+
+// Decodes Flickr's JSON for a photo, in which notes, tags and URLs are each
+// wrapped in an object.  JSON produced by encoding a PhotoInfo is decoded too.
+func (p *PhotoInfo) UnmarshalJSON(data []byte) error {
+	type plain PhotoInfo
+	r := struct {
+		*plain
+		Notes json.RawMessage `json:"notes"`
+		Tags  json.RawMessage `json:"tags"`
+		URLs  json.RawMessage `json:"urls"`
+	}{plain: (*plain)(p)}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return err
+	}
+	if err := unmarshalJSONList(r.Notes, "note", &p.Notes); err != nil {
+		return err
+	}
+	if err := unmarshalJSONList(r.Tags, "tag", &p.Tags); err != nil {
+		return err
+	}
+	return unmarshalJSONList(r.URLs, "url", &p.URLs)
+}
+
+// Decodes data, which is either a list or an object holding the list as its
+// key member, into v.
+func unmarshalJSONList(data json.RawMessage, key string, v interface{}) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case len(data) == 0:
+		return nil
+	case data[0] != '{':
+		return json.Unmarshal(data, v)
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	if list, ok := obj[key]; ok {
+		return json.Unmarshal(list, v)
+	}
+	return nil
+}
+
+// Returns the URL to this photo in the specified size.
+func (p *PhotoInfo) URL(size string) string {
+	ph := Photo{ID: p.ID, Secret: p.Secret, Server: p.Server, Farm: p.Farm}
+	return ph.URL(size)
+}
+
+// Returns the URL to the original photo, as uploaded.  Empty if the caller is
+// not allowed to download the original.
+func (p *PhotoInfo) OriginalURL() string {
+	if p.OriginalSecret == "" {
+		return ""
+	}
+	return fmt.Sprintf("http://farm%s.static.flickr.com/%s/%s_%s_o.%s",
+		p.Farm, p.Server, p.ID, p.OriginalSecret, p.OriginalFormat)
+}
+
+// Owner of a photo.
+type PhotoOwner struct {
+	NSID       string `xml:"nsid,attr" json:"nsid"`
+	UserName   string `xml:"username,attr" json:"username"`
+	RealName   string `xml:"realname,attr" json:"realname"`
+	Location   string `xml:"location,attr" json:"location"`
+	IconServer string `xml:"iconserver,attr" json:"iconserver"`
+	IconFarm   string `xml:"iconfarm,attr" json:"iconfarm"`
+	PathAlias  string `xml:"path_alias,attr" json:"path_alias"`
+}
+
+// Who can see a photo; each field is "1" or "0".
+type Visibility struct {
+	IsPublic string `xml:"ispublic,attr" json:"ispublic"`
+	IsFriend string `xml:"isfriend,attr" json:"isfriend"`
+	IsFamily string `xml:"isfamily,attr" json:"isfamily"`
+}
+
+// Dates of a photo.  Posted and LastUpdate are Unix timestamps; Taken is in
+// the "2006-01-02 15:04:05" format, and is accurate only to
+// TakenGranularity.
+type PhotoDates struct {
+	Posted           string `xml:"posted,attr" json:"posted"`
+	Taken            string `xml:"taken,attr" json:"taken"`
+	TakenGranularity string `xml:"takengranularity,attr" json:"takengranularity"`
+	TakenUnknown     string `xml:"takenunknown,attr" json:"takenunknown"`
+	LastUpdate       string `xml:"lastupdate,attr" json:"lastupdate"`
+}
+
+// Returns Posted as a time.
+func (d *PhotoDates) PostedTime() (time.Time, error) {
+	return parseUnixTime(d.Posted)
+}
+
+// Returns LastUpdate as a time.
+func (d *PhotoDates) LastUpdateTime() (time.Time, error) {
+	return parseUnixTime(d.LastUpdate)
+}
+
+// Parses a Unix timestamp.
+func parseUnixTime(s string) (time.Time, error) {
+	secs, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(secs, 0), nil
+}
+
+// Returns Taken as a time in the UTC location; Flickr does not record the
+// time zone the photo was taken in.
+func (d *PhotoDates) TakenTime() (time.Time, error) {
+	return time.Parse(dateTakenFormat, d.Taken)
+}
+
+// Who can comment on and add notes and tags to a photo.  Each field is one of
+// 0 (nobody), 1 (friends and family), 2 (contacts) or 3 (everybody).
+type Permissions struct {
+	PermComment string `xml:"permcomment,attr" json:"permcomment"`
+	PermAddMeta string `xml:"permaddmeta,attr" json:"permaddmeta"`
+}
+
+// Whether the caller, or everybody, can comment on and add notes and tags to
+// a photo; each field is "1" or "0".
+type Editability struct {
+	CanComment string `xml:"cancomment,attr" json:"cancomment"`
+	CanAddMeta string `xml:"canaddmeta,attr" json:"canaddmeta"`
+}
+
+// A note on a photo, covering the area of W by H pixels at (X, Y) of the
+// 500 pixel version of the photo.
+type Note struct {
+	ID         string `xml:"id,attr" json:"id"`
+	Author     string `xml:"author,attr" json:"author"`
+	AuthorName string `xml:"authorname,attr" json:"authorname"`
+	X          string `xml:"x,attr" json:"x"`
+	Y          string `xml:"y,attr" json:"y"`
+	W          string `xml:"w,attr" json:"w"`
+	H          string `xml:"h,attr" json:"h"`
+	Text       string `xml:",chardata" json:"_content"`
+}
+
+// A tag of a photo.  Text is the normalised form of the tag, and Raw is the
+// tag as it was entered.
+type Tag struct {
+	ID         string `xml:"id,attr" json:"id"`
+	Author     string `xml:"author,attr" json:"author"`
+	AuthorName string `xml:"authorname,attr" json:"authorname"`
+	Raw        string `xml:"raw,attr" json:"raw"`
+	MachineTag string `xml:"machine_tag,attr" json:"machine_tag"`
+	Text       string `xml:",chardata" json:"_content"`
+}
+
+// Reports whether t is a machine tag, like "geo:lat=12.34".
+func (t *Tag) IsMachineTag() bool {
+	return t.MachineTag == "1"
+}
+
+// A URL of a photo; Type is "photopage" for the photo's page on Flickr.
+type PhotoURL struct {
+	Type string `xml:"type,attr" json:"type"`
+	URL  string `xml:",chardata" json:"_content"`
 }
 
 type PersonResponse struct {
-	ID             string `xml:"id,attr"`
-	NSID           string `xml:"nsid,attr"`
-	IsPro          string `xml:"ispro,attr"`
-	IconServer     string `xml:"iconserver,attr"`
-	IconFarm       string `xml:"iconfarm,attr"`
-	PathAlias      string `xml:"path_alias,attr"`
-	Gender         string `xml:"gender,attr"`
-	Ignored        string `xml:"ignored,attr"`
-	Contact        string `xml:"contact,attr"`
-	Friend         string `xml:"friend,attr"`
-	Family         string `xml:"family,attr"`
-	ReverseContact string `xml:"revcontact,attr"`
-	ReverseFriend  string `xml:"revfriend,attr"`
-	ReverseFamily  string `xml:"revfamily,attr"`
-	UserName       string `xml:"username"`
+	ID             string `xml:"id,attr" json:"id"`
+	NSID           string `xml:"nsid,attr" json:"nsid"`
+	IsPro          string `xml:"ispro,attr" json:"ispro"`
+	IconServer     string `xml:"iconserver,attr" json:"iconserver"`
+	IconFarm       string `xml:"iconfarm,attr" json:"iconfarm"`
+	PathAlias      string `xml:"path_alias,attr" json:"path_alias"`
+	Gender         string `xml:"gender,attr" json:"gender"`
+	Ignored        string `xml:"ignored,attr" json:"ignored"`
+	Contact        string `xml:"contact,attr" json:"contact"`
+	Friend         string `xml:"friend,attr" json:"friend"`
+	Family         string `xml:"family,attr" json:"family"`
+	ReverseContact string `xml:"revcontact,attr" json:"revcontact"`
+	ReverseFriend  string `xml:"revfriend,attr" json:"revfriend"`
+	ReverseFamily  string `xml:"revfamily,attr" json:"revfamily"`
+	UserName       string `xml:"username" json:"username"`
 }
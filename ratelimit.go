@@ -0,0 +1,141 @@
+package flickgo
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// Flickr's limit on the number of API calls an API key can make per hour.
+// See https://www.flickr.com/services/developer/api/.
+const CallsPerHour = 3600
+
+// Number of calls the limiters returned by SharedLimiter allow to be made back
+// to back.
+const DefaultBurst = 300
+
+// Limits the rate at which a Client makes requests.  Implementations must be
+// safe for concurrent use.
+type Limiter interface {
+	// Blocks until a request can be made, or until ctx is done, in which case
+	// ctx.Err() is returned.
+	Wait(ctx context.Context) error
+
+	// Returns the number of requests that can be made right away.
+	Remaining() int
+}
+
+// Returns the current time for TokenBucket; a variable so that tests can
+// fake the passage of time.
+var limiterNow = time.Now
+
+// A token bucket rate limiter.  Safe for concurrent use.
+type TokenBucket struct {
+	mu sync.Mutex
+
+	// Maximum number of tokens in the bucket.
+	capacity float64
+
+	// Tokens currently in the bucket; each call consumes one.
+	tokens float64
+
+	// Time it takes for one token to be added to the bucket.
+	interval time.Duration
+
+	// When tokens was last updated.
+	last time.Time
+}
+
+// Creates a TokenBucket that allows at most limit calls in any one-hour
+// period, up to burst of which can be made back to back.  burst must be less
+// than limit.  The bucket starts full.
+func NewTokenBucket(limit, burst int) *TokenBucket {
+	if burst < 1 || burst >= limit {
+		panic("burst must be between 1 and limit")
+	}
+	return &TokenBucket{
+		capacity: float64(burst),
+		tokens:   float64(burst),
+		interval: time.Hour / time.Duration(limit-burst),
+		last:     limiterNow(),
+	}
+}
+
+// Adds the tokens accumulated since b.last.  b.mu must be held.
+func (b *TokenBucket) refill() {
+	t := limiterNow()
+	if t.After(b.last) {
+		b.tokens += float64(t.Sub(b.last)) / float64(b.interval)
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = t
+	}
+}
+
+// Blocks until a token is available and consumes it.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		b.refill()
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return nil
+		}
+		d := time.Duration((1 - b.tokens) * float64(b.interval))
+		b.mu.Unlock()
+		if err := sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the number of calls that can be made right away.
+func (b *TokenBucket) Remaining() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return int(math.Floor(b.tokens))
+}
+
+// Limiters returned by SharedLimiter, keyed by API key.
+var (
+	sharedMu       sync.Mutex
+	sharedLimiters = make(map[string]*TokenBucket)
+)
+
+// Returns the limiter shared by all Clients for apiKey.  New sets it as the
+// Limiter of the Clients it creates, so that they together make no more than
+// CallsPerHour calls per hour.
+func SharedLimiter(apiKey string) *TokenBucket {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	b, ok := sharedLimiters[apiKey]
+	if !ok {
+		b = NewTokenBucket(CallsPerHour, DefaultBurst)
+		sharedLimiters[apiKey] = b
+	}
+	return b
+}
+
+// Returns the number of calls c can make right away without waiting for its
+// Limiter, or -1 if c has no Limiter.
+func (c *Client) RemainingCalls() int {
+	if c.Limiter == nil {
+		return -1
+	}
+	return c.Limiter.Remaining()
+}
+
+// Waits until c's limiter allows a request to be made.
+func waitLimiter(c *Client) error {
+	if c.Limiter == nil {
+		return nil
+	}
+	if err := c.Limiter.Wait(c.Context()); err != nil {
+		return wrapErr("rate limiter wait failed", err)
+	}
+	return nil
+}
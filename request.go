@@ -3,23 +3,27 @@ package flickgo
 import (
 	"bytes"
 	"crypto/md5"
+	"encoding/json"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/textproto"
 	"net/url"
-	"path/filepath"
+	"path"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 )
 
 const (
-	service   = "https://api.flickr.com/services"
-	uploadURL = "https://api.flickr.com/services/upload"
+	service    = "https://api.flickr.com/services"
+	uploadURL  = "https://api.flickr.com/services/upload"
+	replaceURL = "https://up.flickr.com/services/replace/"
 )
 
 // Returns all keys of map m.
@@ -51,8 +55,29 @@ func clone(m map[string]string) map[string]string {
 	return r
 }
 
+// Returns an error that adds msg to err; err can be retrieved using
+// errors.Unwrap, errors.Is and errors.As.
 func wrapErr(msg string, err error) error {
-	return errors.New(msg + ": " + err.Error())
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// Formats tags as a space separated list, as expected by Flickr.  Tags with
+// spaces in them, including machine tags with such values, are enclosed in
+// double quotes; Flickr does not support double quotes within tags, so they
+// are removed.
+func joinTags(tags []string) string {
+	quoted := make([]string, 0, len(tags))
+	for _, t := range tags {
+		t = strings.TrimSpace(strings.Replace(t, `"`, "", -1))
+		if t == "" {
+			continue
+		}
+		if strings.ContainsAny(t, " \t") {
+			t = `"` + t + `"`
+		}
+		quoted = append(quoted, t)
+	}
+	return strings.Join(quoted, " ")
 }
 
 // Returns an API signature for the given arguments.
@@ -80,11 +105,22 @@ func signedURL(secret string, apiKey string, path string, args map[string]string
 }
 
 // Returns a URL for invoking a Flickr method with the specified arguments.  If
-// c has its AuthToken field set, the auth token is added to the URL.  Returned
-// URL is always signed with c.secret.
+// c has its OAuthToken field set, the URL is signed using OAuth, and the token
+// is included if authenticated is true.  Otherwise, if authenticated is true,
+// c.AuthToken is added to the URL and the URL is signed with c.secret.
 func makeURL(c *Client, method string, args map[string]string, authenticated bool) string {
 	a := clone(args)
 	a["method"] = method
+	if c.Format == FormatJSON {
+		a["format"] = FormatJSON
+		a["nojsoncallback"] = "1"
+	}
+	if c.OAuthToken != "" {
+		if authenticated {
+			return oauthURL(c, service+"/rest/", a, c.OAuthToken, c.OAuthTokenSecret)
+		}
+		return oauthURL(c, service+"/rest/", a, "", "")
+	}
 	a["api_key"] = c.apiKey
 	var u string
 	if authenticated {
@@ -111,10 +147,80 @@ func extractJSON(jsonp []byte) []byte {
 	return end.ReplaceAll(t, empty)
 }
 
-// Processes a response and returns JSON content from it.
-func processReponse(c *Client, r *http.Response) (io.ReadCloser, error) {
-	// TODO: handle error response codes like 401 and 500.
+// Reports whether body is a JSON (or JSONP) response rather than XML.
+func isJSON(body []byte) bool {
+	t := bytes.TrimLeft(body, " \t\r\n")
+	return bytes.HasPrefix(t, []byte("{")) || begin.Match(t)
+}
 
+// Rewrites a value decoded from Flickr's JSON so that it can be decoded into
+// the types used for XML responses: text content, which Flickr wraps in
+// {"_content": ...} objects, is unwrapped, and numbers and booleans are
+// converted to strings.
+func normalizeJSON(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if content, ok := t["_content"]; ok && len(t) == 1 {
+			return normalizeJSON(content)
+		}
+		for k, e := range t {
+			t[k] = normalizeJSON(e)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = normalizeJSON(e)
+		}
+	case json.Number:
+		return t.String()
+	case bool:
+		if t {
+			return "1"
+		}
+		return "0"
+	}
+	return v
+}
+
+// Decodes JSON response in, after normalising it with normalizeJSON, into
+// each of resps.
+func parseJSON(in []byte, logger Debugfer, resps ...interface{}) error {
+	data := extractJSON(in)
+	if logger != nil {
+		logger.Debugf("Parsing JSON %s", string(data))
+	}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return wrapErr("JSON parsing failed", err)
+	}
+	normalized, mErr := json.Marshal(normalizeJSON(v))
+	if mErr != nil {
+		return wrapErr("JSON normalisation failed", mErr)
+	}
+	for _, resp := range resps {
+		if err := json.Unmarshal(normalized, resp); err != nil {
+			return wrapErr("JSON parsing failed", err)
+		}
+	}
+	return nil
+}
+
+// Processes a response and returns its body.  Returns an *HTTPError if the
+// response has an error status code.
+func processReponse(c *Client, r *http.Response) (io.ReadCloser, error) {
+	if r.StatusCode >= 300 {
+		defer r.Body.Close()
+		snippet, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxErrorBody))
+		if c.Logger != nil {
+			c.Logger.Debugf("HTTP error %d: %s", r.StatusCode, string(snippet))
+		}
+		return nil, &HTTPError{
+			StatusCode: r.StatusCode,
+			Status:     r.Status,
+			Body:       string(snippet),
+		}
+	}
 	return r.Body, nil
 }
 
@@ -130,44 +236,194 @@ func parseXML(in io.Reader, resp interface{}, logger Debugfer) error {
 	return nil
 }
 
-// Sends a GET request to u and returns the response JSON.
-func fetch(c *Client, u string) (io.ReadCloser, error) {
-	r, getErr := c.httpClient.Get(u)
+// Returns the name of the Flickr API method invoked by a request to u.  Upload
+// requests do not have a method, so the name of the endpoint is returned
+// instead.
+func apiMethod(u string) string {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ""
+	}
+	if m := parsed.Query().Get("method"); m != "" {
+		return m
+	}
+	return path.Base(path.Clean(parsed.Path))
+}
+
+// Parses the XML or JSON in the body of r, a response to an invocation of
+// method, and populates values in resp.  If Flickr reported a failure,
+// returns an *Error.
+func parseResponse(c *Client, method string, r *http.Response, resp interface{}) error {
+	in, pErr := processReponse(c, r)
+	if pErr != nil {
+		return wrapErr("error response", pErr)
+	}
+	defer in.Close()
+	body, rErr := ioutil.ReadAll(in)
+	if rErr != nil {
+		return wrapErr("reading response failed", rErr)
+	}
+	if isJSON(body) {
+		// Error details are in the top-level object of JSON responses.
+		status := struct {
+			Stat string `json:"stat"`
+			flickrError
+		}{}
+		if err := parseJSON(body, c.Logger, resp, &status); err != nil {
+			return err
+		}
+		if status.Stat != "ok" {
+			return status.Err(method, r.StatusCode)
+		}
+		return nil
+	}
+	if err := parseXML(bytes.NewReader(body), resp, c.Logger); err != nil {
+		return err
+	}
+	status := struct {
+		Stat string      `xml:"stat,attr"`
+		Err  flickrError `xml:"err"`
+	}{}
+	if err := xml.Unmarshal(body, &status); err != nil {
+		return wrapErr("XML parsing failed", err)
+	}
+	if status.Stat != "ok" {
+		return status.Err.Err(method, r.StatusCode)
+	}
+	return nil
+}
+
+// Sends a GET request to u using c's context, after waiting for c's limiter.
+func get(c *Client, u string) (*http.Response, error) {
+	if err := waitLimiter(c); err != nil {
+		return nil, err
+	}
+	req, rErr := http.NewRequestWithContext(c.Context(), "GET", u, nil)
+	if rErr != nil {
+		return nil, wrapErr("request creation failed", rErr)
+	}
+	r, getErr := c.httpClient.Do(req)
 	if getErr != nil {
 		return nil, wrapErr("GET failed", getErr)
 	}
-	return processReponse(c, r)
+	return r, nil
 }
 
-// Sends a Flickr request, parses the response XML, and populates values in
-// resp.  url represents the complete Flickr request with the arguments signed
-// with the API secret.
-func flickrGet(c *Client, url_ string, resp interface{}) error {
-	if c.Logger != nil {
-		c.Logger.Debugf("GET %v\n", url_)
-	}
-	in, err := fetch(c, url_)
+// Sends a GET request to u and returns the response JSON.
+func fetch(c *Client, u string) (io.ReadCloser, error) {
+	r, err := get(c, u)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer in.Close()
-	return parseXML(in, resp, c.Logger)
+	return processReponse(c, r)
+}
+
+// Sends a Flickr request, parses the response XML, and populates values in
+// resp.  urlFn returns the complete Flickr request with the arguments signed
+// with the API secret; it is called for each attempt, so that each one has a
+// fresh OAuth nonce and timestamp.  If Flickr reports a failure, the returned
+// error is an *Error.  Failed requests are retried as specified by c.Retry;
+// idempotent tells whether the request can be repeated without side effects.
+func flickrGet(c *Client, idempotent bool, urlFn func() string, resp interface{}) error {
+	return withRetries(c, idempotent, func() error {
+		u := urlFn()
+		if c.Logger != nil {
+			c.Logger.Debugf("GET %v\n", u)
+		}
+		r, err := get(c, u)
+		if err != nil {
+			return err
+		}
+		return parseResponse(c, apiMethod(u), r, resp)
+	})
 }
 
+// Sends req, parses the response XML, and populates values in resp.  req
+// should have been created with c's context.  If Flickr reports a failure, the
+// returned error is an *Error.  req is treated as non-idempotent when
+// retrying, and is never retried if its body cannot be recreated.
 func flickrPost(c *Client, req *http.Request, resp interface{}) error {
 	if c.Logger != nil {
 		c.Logger.Debugf("POST %v\n", req.URL)
 	}
-	r, rErr := c.httpClient.Do(req)
-	if rErr != nil {
-		return rErr
+	send := func() error {
+		if err := waitLimiter(c); err != nil {
+			// Do closes the body, which stops the goroutine streaming it;
+			// since Do is not reached, it is closed here instead.
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return err
+		}
+		r, rErr := c.httpClient.Do(req)
+		if rErr != nil {
+			return rErr
+		}
+		return parseResponse(c, apiMethod(req.URL.String()), r, resp)
 	}
-	in, pErr := processReponse(c, r)
-	if pErr != nil {
-		return wrapErr("error response", pErr)
+	if req.GetBody == nil {
+		return send()
 	}
-	defer in.Close()
-	return parseXML(in, resp, c.Logger)
+	first := true
+	return withRetries(c, false, func() error {
+		if !first {
+			body, err := req.GetBody()
+			if err != nil {
+				return wrapErr("request body recreation failed", err)
+			}
+			req.Body = body
+		}
+		first = false
+		return send()
+	})
+}
+
+// Returns the signed form for an authenticated POST request invoking the
+// given API method; the POST counterpart of makeURL.
+func makeForm(c *Client, method string, args map[string]string) *url.Values {
+	a := clone(args)
+	a["method"] = method
+	if c.Format == FormatJSON {
+		a["format"] = FormatJSON
+		a["nojsoncallback"] = "1"
+	}
+	if c.OAuthToken != "" {
+		a = oauthArgs(c, "POST", service+"/rest/", a, c.OAuthToken, c.OAuthTokenSecret)
+	} else {
+		a["api_key"] = c.apiKey
+		a["auth_token"] = c.AuthToken
+		a["api_sig"] = sign(c.secret, a)
+	}
+	return queryValues(a)
+}
+
+// Invokes an API method that modifies data with an authenticated POST
+// request, as Flickr requires for such methods, and decodes the response into
+// resp.  The request is signed afresh for each attempt, so that retries do not
+// reuse OAuth nonces.  idempotent tells whether the method can safely be
+// repeated; see withRetries.
+func flickrPostForm(c *Client, idempotent bool, method string, args map[string]string,
+	resp interface{}) error {
+	if c.Logger != nil {
+		c.Logger.Debugf("POST %v\n", method)
+	}
+	return withRetries(c, idempotent, func() error {
+		if err := waitLimiter(c); err != nil {
+			return err
+		}
+		form := makeForm(c, method, args).Encode()
+		req, rErr := http.NewRequestWithContext(c.Context(), "POST", service+"/rest/",
+			strings.NewReader(form))
+		if rErr != nil {
+			return wrapErr("request creation failed", rErr)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r, pErr := c.httpClient.Do(req)
+		if pErr != nil {
+			return wrapErr("POST failed", pErr)
+		}
+		return parseResponse(c, method, r, resp)
+	})
 }
 
 // Copied from mime/multipart/writer.go.
@@ -177,18 +433,35 @@ func escapeQuotes(s string) string {
 	return s
 }
 
-var contentType = map[string]string{
-	".jpg":  "image/jpeg",
-	".jpeg": "image/jpeg",
-	".jpe":  "image/jpeg",
-	".gif":  "image/gif",
-	".png":  "image/png",
+// Writer that reports the progress of writing a photo of total bytes to w.
+type progressWriter struct {
+	w        io.Writer
+	sent     int64
+	total    int64
+	progress ProgressFunc
 }
 
-func multipartWriter(w io.Writer, filename string, photo []byte,
-	args map[string]string) (*multipart.Writer, error) {
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.sent += int64(n)
+	pw.progress(pw.sent, pw.total)
+	return n, err
+}
+
+// Writes a multipart form containing args and photo to w, using boundary as
+// the multipart boundary and ctype as the photo's MIME type.  If progress is
+// not nil, it is called as the photo is written; size is the size of the
+// photo, or -1 if unknown.
+func multipartWriter(w io.Writer, boundary string, filename string, ctype string,
+	photo io.Reader, size int64, args map[string]string, progress ProgressFunc) (*multipart.Writer, error) {
 	mpw := multipart.NewWriter(w)
-	for k, v := range args {
+	if err := mpw.SetBoundary(boundary); err != nil {
+		return nil, wrapErr("invalid boundary", err)
+	}
+	ks := keys(args)
+	ks.Sort()
+	for _, k := range ks {
+		v := args[k]
 		if err := mpw.WriteField(k, v); err != nil {
 			return nil, wrapErr(fmt.Sprintf("field write failed [%v=%v]", k, v), err)
 		}
@@ -197,12 +470,16 @@ func multipartWriter(w io.Writer, filename string, photo []byte,
 	h.Set("Content-Disposition",
 		fmt.Sprintf(`form-data; name="photo"; filename="%s"`,
 			escapeQuotes(filename)))
-	h.Set("Content-Type", contentType[strings.ToLower(filepath.Ext(filename))])
+	h.Set("Content-Type", ctype)
 	w, cErr := mpw.CreatePart(h)
 	if cErr != nil {
 		return nil, wrapErr("form file creation failed ["+filename+"]", cErr)
 	}
-	if _, err := w.Write(photo); err != nil {
+	if progress != nil {
+		progress(0, size)
+		w = &progressWriter{w: w, total: size, progress: progress}
+	}
+	if _, err := io.Copy(w, photo); err != nil {
 		return nil, wrapErr("adding photo data failed", err)
 	}
 	if err := mpw.Close(); err != nil {
@@ -211,24 +488,129 @@ func multipartWriter(w io.Writer, filename string, photo []byte,
 	return mpw, nil
 }
 
-func uploadRequest(c *Client, filename string, photo []byte,
-	args map[string]string) (*http.Request, error) {
+// Returns a reader that streams the multipart form written by
+// multipartWriter.  The form is written by a separate goroutine as the reader
+// is read, so photo is never held in memory in full.  Since the pipe is not
+// buffered, progress is called with the number of bytes of photo that have
+// been read from the returned reader.  The returned channel is closed when the
+// goroutine stops using photo, which it does soon after the reader is closed.
+func multipartBody(boundary string, filename string, ctype string, photo io.Reader,
+	size int64, args map[string]string, progress ProgressFunc) (io.ReadCloser, <-chan struct{}) {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := multipartWriter(pw, boundary, filename, ctype, photo, size, args, progress)
+		pw.CloseWithError(err)
+	}()
+	return pr, done
+}
+
+// Writer that counts the bytes written to it and discards them.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// Returns a request for posting photo, whose size is size bytes (or -1 if
+// unknown), to endpoint, which is uploadURL or replaceURL.  The photo is
+// streamed into the request body as the request is sent.  If photo is an
+// io.Seeker, the request body can be recreated for retrying by seeking photo
+// back to its current position.  progress, if not nil, is called from a
+// separate goroutine as the photo is sent.  The upload is asynchronous unless
+// args has "async" set to "0".
+func multipartRequest(c *Client, endpoint string, filename string, photo io.Reader,
+	size int64, args map[string]string, progress ProgressFunc) (*http.Request, error) {
 	a := clone(args)
-	a["api_key"] = c.apiKey
-	a["auth_token"] = c.AuthToken
-	a["async"] = "1"
-	a["api_sig"] = sign(c.secret, a)
+	if a["async"] == "" {
+		a["async"] = "1"
+	}
+	// Signs the form fields; called again for each retry, so that each
+	// attempt has a fresh OAuth nonce and timestamp.
+	signArgs := func() map[string]string {
+		if c.OAuthToken != "" {
+			return oauthArgs(c, "POST", endpoint, a, c.OAuthToken, c.OAuthTokenSecret)
+		}
+		signed := clone(a)
+		signed["api_key"] = c.apiKey
+		signed["auth_token"] = c.AuthToken
+		signed["api_sig"] = sign(c.secret, signed)
+		return signed
+	}
+	signed := signArgs()
 
-	buf := bytes.NewBuffer(make([]byte, 0, len(photo)*2))
-	mpw, wErr := multipartWriter(buf, filename, photo, a)
-	if wErr != nil {
-		return nil, wrapErr("writer creation failed", wErr)
+	// The file type is detected before the form is streamed, so that
+	// unsupported files are rejected without sending anything.
+	seeker, seekable := photo.(io.Seeker)
+	var start int64
+	if seekable {
+		var sErr error
+		if start, sErr = seeker.Seek(0, io.SeekCurrent); sErr != nil {
+			seekable = false
+		}
+	}
+	head := make([]byte, sniffLen)
+	n, hErr := io.ReadFull(photo, head)
+	if hErr != nil && hErr != io.EOF && hErr != io.ErrUnexpectedEOF {
+		return nil, wrapErr("reading photo failed", hErr)
+	}
+	head = head[:n]
+	ctype, tErr := detectContentType(filename, head)
+	if tErr != nil {
+		return nil, tErr
 	}
 
-	req, rErr := http.NewRequest("POST", uploadURL, buf)
+	mpw := multipart.NewWriter(nil)
+	boundary := mpw.Boundary()
+	// Returns the length of the form with the given fields, or -1 if the size
+	// of the photo is unknown.  The form size is the size of an empty form
+	// plus the size of the photo.
+	formLength := func(fields map[string]string) (int64, error) {
+		if size < 0 {
+			return -1, nil
+		}
+		var cw countingWriter
+		if _, err := multipartWriter(&cw, boundary, filename, ctype, bytes.NewReader(nil), 0,
+			fields, nil); err != nil {
+			return 0, wrapErr("writer creation failed", err)
+		}
+		return int64(cw) + size, nil
+	}
+	length, lErr := formLength(signed)
+	if lErr != nil {
+		return nil, lErr
+	}
+
+	body, done := multipartBody(boundary, filename, ctype,
+		io.MultiReader(bytes.NewReader(head), photo), size, signed, progress)
+	req, rErr := http.NewRequestWithContext(c.Context(), "POST", endpoint, body)
 	if rErr != nil {
+		body.Close()
 		return nil, wrapErr("request creation failed", rErr)
 	}
+	req.ContentLength = length
 	req.Header.Set("Content-Type", mpw.FormDataContentType())
+	if seekable {
+		var mu sync.Mutex
+		req.GetBody = func() (io.ReadCloser, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			resigned := signArgs()
+			if l, err := formLength(resigned); err != nil || l != length {
+				return nil, errors.New("form length changed by signing")
+			}
+			// The transport may still be reading the previous body, so its
+			// writer is stopped before photo is rewound for the new one.
+			body.Close()
+			<-done
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+			body, done = multipartBody(boundary, filename, ctype, photo, size, resigned, progress)
+			return body, nil
+		}
+	}
 	return req, nil
 }
@@ -0,0 +1,140 @@
+package flickgo
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"net/url"
+	"time"
+)
+
+// Flickr error codes retried when RetryPolicy.RetryableCodes is nil.
+var DefaultRetryableCodes = []int{
+	ErrServiceUnavailable.Code,
+}
+
+// Policy for retrying requests that fail with transient errors: Flickr
+// errors with one of RetryableCodes, HTTP 429 and 5xx responses, and network
+// failures.  Set it as Client's Retry field to enable retries.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first one.  Values less than
+	// 2 disable retries.
+	MaxAttempts int
+
+	// Delay before the first retry.
+	InitialBackoff time.Duration
+
+	// Upper limit for the delay between attempts; 0 means no limit.
+	MaxBackoff time.Duration
+
+	// Factor by which the delay grows after each retry; values less than 1
+	// mean 2.
+	Multiplier float64
+
+	// Fraction of each delay that is randomised, between 0 and 1.  For
+	// example, 0.2 makes each delay vary by up to 20% either way, so that
+	// clients failing together do not retry together.
+	Jitter float64
+
+	// Flickr error codes that are retried; nil means DefaultRetryableCodes.
+	RetryableCodes []int
+
+	// Uploads are not idempotent: if an upload times out or fails with an
+	// HTTP error, Flickr may have created the photo anyway, and retrying it
+	// can create a duplicate.  So uploads are retried only when Flickr reports
+	// an error with one of RetryableCodes, unless this field is set.
+	RetryNonIdempotent bool
+}
+
+// Returns a policy that makes up to 4 attempts, with delays starting at one
+// second and growing up to 30 seconds.
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Second,
+		MaxBackoff:     30 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// Returns the delay before the nth retry, starting from 0.
+func (p *RetryPolicy) backoff(n int) time.Duration {
+	mult := p.Multiplier
+	if mult < 1 {
+		mult = 2
+	}
+	d := float64(p.InitialBackoff) * math.Pow(mult, float64(n))
+	if p.MaxBackoff > 0 && d > float64(p.MaxBackoff) {
+		d = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// Reports whether a request that failed with err should be retried.
+// idempotent tells whether the request can be repeated without side effects.
+func (p *RetryPolicy) retryable(err error, idempotent bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var fErr *Error
+	if errors.As(err, &fErr) {
+		codes := p.RetryableCodes
+		if codes == nil {
+			codes = DefaultRetryableCodes
+		}
+		for _, code := range codes {
+			if fErr.Code == code {
+				return true
+			}
+		}
+		return false
+	}
+	if !idempotent && !p.RetryNonIdempotent {
+		return false
+	}
+	var hErr *HTTPError
+	if errors.As(err, &hErr) {
+		return hErr.StatusCode == 429 || hErr.StatusCode >= 500
+	}
+	var uErr *url.Error
+	return errors.As(err, &uErr)
+}
+
+// Waits for d or until ctx is done; replaced in tests.
+var sleep = func(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Calls send, and calls it again as allowed by c.Retry as long as it fails
+// with a retryable error.  idempotent tells whether the request made by send
+// can be repeated without side effects.
+func withRetries(c *Client, idempotent bool, send func() error) error {
+	p := c.Retry
+	err := send()
+	if p == nil {
+		return err
+	}
+	for n := 0; err != nil && n+1 < p.MaxAttempts && p.retryable(err, idempotent); n++ {
+		d := p.backoff(n)
+		if c.Logger != nil {
+			c.Logger.Debugf("Retrying in %v after error: %v", d, err)
+		}
+		if sErr := sleep(c.Context(), d); sErr != nil {
+			return wrapErr("retry aborted", sErr)
+		}
+		err = send()
+	}
+	return err
+}
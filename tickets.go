@@ -0,0 +1,106 @@
+package flickgo
+
+import (
+	"errors"
+	"time"
+)
+
+// Errors reported by WaitForTickets for tickets that will never complete.
+var (
+	// Flickr does not recognise the ticket.
+	ErrInvalidTicket = errors.New("invalid upload ticket")
+
+	// Flickr failed to process the uploaded photo.
+	ErrUploadFailed = errors.New("upload processing failed")
+)
+
+// Maximum number of tickets checked with one checkTickets call.
+const maxTicketsPerCheck = 50
+
+// Delays between successive checks of pending tickets.
+const (
+	ticketPollInitial = time.Second
+	ticketPollMax     = 30 * time.Second
+)
+
+// Outcome of an asynchronous upload.
+type TicketResult struct {
+	// ID of the uploaded photo; empty if the upload did not complete.
+	PhotoID string
+
+	// Reason the upload did not complete: ErrInvalidTicket, ErrUploadFailed,
+	// or the error that stopped WaitForTickets.
+	Err error
+}
+
+// Waits for asynchronous uploads to complete, by polling their tickets with
+// CheckTickets at increasing intervals, and returns the outcome of each
+// ticket.  Polling stops when all tickets are complete, invalid or failed; when
+// c's context is done; or when checking tickets fails with an error that
+// c.Retry does not retry.  In the latter cases, the error is returned, and it
+// is also the Err of the tickets that were still pending.  The returned map
+// has an entry for every ticket in either case.
+func (c *Client) WaitForTickets(tickets []string) (map[string]TicketResult, error) {
+	results := make(map[string]TicketResult)
+	pending := make([]string, 0, len(tickets))
+	for _, t := range tickets {
+		if _, ok := results[t]; !ok {
+			results[t] = TicketResult{}
+			pending = append(pending, t)
+		}
+	}
+
+	delay := ticketPollInitial
+	for len(pending) > 0 {
+		if err := sleep(c.Context(), delay); err != nil {
+			return results, failPending(results, pending, err)
+		}
+		if delay = delay * 3 / 2; delay > ticketPollMax {
+			delay = ticketPollMax
+		}
+
+		var stillPending []string
+		for start := 0; start < len(pending); start += maxTicketsPerCheck {
+			end := start + maxTicketsPerCheck
+			if end > len(pending) {
+				end = len(pending)
+			}
+			statuses, err := c.CheckTickets(pending[start:end])
+			if err != nil {
+				stillPending = append(stillPending, pending[start:]...)
+				return results, failPending(results, stillPending, err)
+			}
+			checked := make(map[string]bool)
+			for _, s := range statuses {
+				checked[s.ID] = true
+				switch {
+				case s.Invalid == "1":
+					results[s.ID] = TicketResult{Err: ErrInvalidTicket}
+				case s.Complete == "1":
+					results[s.ID] = TicketResult{PhotoID: s.PhotoID}
+				case s.Complete == "2":
+					results[s.ID] = TicketResult{Err: ErrUploadFailed}
+				default:
+					stillPending = append(stillPending, s.ID)
+				}
+			}
+			// Tickets missing from the response are checked again.
+			for _, t := range pending[start:end] {
+				if !checked[t] {
+					stillPending = append(stillPending, t)
+				}
+			}
+		}
+		pending = stillPending
+	}
+	return results, nil
+}
+
+// Sets err as the result of each of pending tickets, and returns err.
+func failPending(results map[string]TicketResult, pending []string, err error) error {
+	err = wrapErr("waiting for tickets failed", err)
+	for _, t := range pending {
+		results[t] = TicketResult{Err: err}
+	}
+	return err
+}